@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: GPL-2.0
+//
+// tc programs of the ebpf firewall flavor, ingress rewrites the public
+// ip:port of a mapping to the pod, egress rewrites the replies of the pod
+// back to the public ip:port. Build with:
+//
+//   clang -O2 -g -target bpfel -c podnat.c -o podnat.o
+
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/pkt_cls.h>
+#include <linux/tcp.h>
+#include <linux/udp.h>
+#include <stddef.h>
+
+#define SEC(name) __attribute__((section(name), used))
+#define INLINE static inline __attribute__((always_inline))
+
+// bpfel target only, network byte order constants
+#define NET16(x) __builtin_bswap16(x)
+
+// keep in sync with natKey and natValue in internal/firewall/ebpf.go
+struct podnat_key {
+	__u32 addr;
+	__u16 port;
+	__u8 proto;
+	__u8 pad;
+};
+
+struct podnat_value {
+	__u32 addr;
+	__u16 port;
+	__u16 pad;
+};
+
+// the maps are created and pinned by the controller, the loader only
+// resolves the references by symbol name
+struct podnat_map_def {
+	__u32 type;
+	__u32 key_size;
+	__u32 value_size;
+	__u32 max_entries;
+};
+
+struct podnat_map_def SEC("maps") podnat_dnat = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(struct podnat_key),
+	.value_size = sizeof(struct podnat_value),
+	.max_entries = 65536,
+};
+
+struct podnat_map_def SEC("maps") podnat_snat = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(struct podnat_key),
+	.value_size = sizeof(struct podnat_value),
+	.max_entries = 65536,
+};
+
+static void *(*bpf_map_lookup_elem)(void *map, const void *key) = (void *)BPF_FUNC_map_lookup_elem;
+static long (*bpf_skb_store_bytes)(struct __sk_buff *skb, __u32 offset, const void *from, __u32 len,
+				   __u64 flags) = (void *)BPF_FUNC_skb_store_bytes;
+static long (*bpf_l3_csum_replace)(struct __sk_buff *skb, __u32 offset, __u64 from, __u64 to,
+				   __u64 size) = (void *)BPF_FUNC_l3_csum_replace;
+static long (*bpf_l4_csum_replace)(struct __sk_buff *skb, __u32 offset, __u64 from, __u64 to,
+				   __u64 flags) = (void *)BPF_FUNC_l4_csum_replace;
+
+INLINE int rewrite(struct __sk_buff *skb, void *map, int ingress)
+{
+	void *data = (void *)(long)skb->data;
+	void *data_end = (void *)(long)skb->data_end;
+	struct ethhdr *eth = data;
+	struct iphdr *ip = data + sizeof(*eth);
+	__u32 ip_off = sizeof(*eth);
+	__u32 l4_off = ip_off + sizeof(*ip);
+	__u32 addr_off, port_off, csum_off;
+	__u64 l4_flags = 0;
+	struct podnat_key key = {};
+	struct podnat_value *found, nat;
+	__u16 *ports;
+
+	if (data + l4_off + 2 * sizeof(__u16) > data_end)
+		return TC_ACT_OK;
+	if (eth->h_proto != NET16(ETH_P_IP))
+		return TC_ACT_OK;
+	// no ip options and no fragments, the ports are only in the first one
+	if (ip->ihl != 5 || (ip->frag_off & NET16(0x3fff)))
+		return TC_ACT_OK;
+
+	switch (ip->protocol) {
+	case IPPROTO_TCP:
+		csum_off = l4_off + offsetof(struct tcphdr, check);
+		break;
+	case IPPROTO_UDP:
+		csum_off = l4_off + offsetof(struct udphdr, check);
+		// a zero udp checksum means none and has to stay zero
+		l4_flags = BPF_F_MARK_MANGLED_0;
+		break;
+	default:
+		return TC_ACT_OK;
+	}
+
+	// source and destination port are at the same offset for tcp and udp
+	ports = data + l4_off;
+	key.proto = ip->protocol;
+	if (ingress) {
+		key.addr = ip->daddr;
+		key.port = ports[1];
+		addr_off = ip_off + offsetof(struct iphdr, daddr);
+		port_off = l4_off + sizeof(__u16);
+	} else {
+		key.addr = ip->saddr;
+		key.port = ports[0];
+		addr_off = ip_off + offsetof(struct iphdr, saddr);
+		port_off = l4_off;
+	}
+
+	found = bpf_map_lookup_elem(map, &key);
+	if (!found)
+		return TC_ACT_OK;
+	// the controller may update the entry concurrently
+	nat = *found;
+
+	// the packet pointers are invalid after the helpers, only offsets are used
+	bpf_l4_csum_replace(skb, csum_off, key.addr, nat.addr, l4_flags | BPF_F_PSEUDO_HDR | sizeof(nat.addr));
+	bpf_l4_csum_replace(skb, csum_off, key.port, nat.port, l4_flags | sizeof(nat.port));
+	bpf_l3_csum_replace(skb, ip_off + offsetof(struct iphdr, check), key.addr, nat.addr, sizeof(nat.addr));
+	bpf_skb_store_bytes(skb, addr_off, &nat.addr, sizeof(nat.addr), 0);
+	bpf_skb_store_bytes(skb, port_off, &nat.port, sizeof(nat.port), 0);
+
+	return TC_ACT_OK;
+}
+
+SEC("tc/ingress")
+int podnat_ingress(struct __sk_buff *skb)
+{
+	return rewrite(skb, &podnat_dnat, 1);
+}
+
+SEC("tc/egress")
+int podnat_egress(struct __sk_buff *skb)
+{
+	return rewrite(skb, &podnat_snat, 0);
+}
+
+char _license[] SEC("license") = "GPL";
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/firewall"
+	"os"
+
+	"k8s.io/klog/v2"
+)
+
+// runCleanup removes all chains and jump rules of the resource prefix and
+// optionally the state of the node
+func runCleanup(args []string) int {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	deleteState := fs.Bool("deleteState", false, "delete the state of the node in the state store")
+	fs.StringVar(&common.NodeID, "nodeID", common.NodeID, "k8s node identifier of the state")
+	fs.StringVar(&common.StateFlavor, "stateFlavor", common.StateFlavor, "state implementation to save iptables rules")
+	fs.StringVar(&common.ResourcePrefix, "resourcePrefix", common.ResourcePrefix, "resource prefix used for firewall chains and comments")
+	fs.BoolVar(&common.DryRun, "dryRun", common.DryRun, "print the rules and chains to delete only")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s cleanup [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	store, err := newStateStore()
+	if err != nil {
+		klog.Errorf("%v\n", err)
+		return 1
+	}
+	proc, err := firewall.NewIpTablesInspector(store)
+	if err != nil {
+		klog.Errorf("%v\n", err)
+		return 1
+	}
+	if err := proc.Cleanup(); err != nil {
+		klog.Errorf("cleanup failed: %v\n", err)
+		return 1
+	}
+	if *deleteState && !common.DryRun {
+		if err := store.Delete(); err != nil {
+			klog.Errorf("could not delete state of node %s: %v\n", common.NodeID, err)
+			return 1
+		}
+	}
+	return 0
+}
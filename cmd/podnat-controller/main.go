@@ -1,19 +1,32 @@
 package main
 
 import (
+	"context"
 	"flag"
-	"github.com/gutmensch/podnat-controller/internal/api"
 	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/config"
 	"github.com/gutmensch/podnat-controller/internal/controller"
 	"github.com/gutmensch/podnat-controller/internal/firewall"
+	"github.com/gutmensch/podnat-controller/internal/floatingip"
 	"github.com/gutmensch/podnat-controller/internal/http"
+	"github.com/gutmensch/podnat-controller/internal/kube"
 	"github.com/gutmensch/podnat-controller/internal/state"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
 	"k8s.io/klog/v2"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var (
 	fwProc  firewall.Processor
 	fwState state.StateStore
+	clients *kube.Clients
+	kubeQPS float64
 )
 
 func init() {
@@ -21,44 +34,305 @@ func init() {
 	flag.StringVar(&common.AnnotationKey, "annotationKey", "bln.space/podnat", "pod annotation key for iptables NAT trigger")
 	flag.IntVar(&common.HTTPPort, "httpPort", 8484, "http service port number")
 	flag.IntVar(&common.InformerResync, "informerResync", 180, "kubernetes informer resync interval")
+	flag.IntVar(&common.RuleStaleness, "ruleStaleness", 600, "seconds without pod refresh until NAT rule is removed")
+	flag.IntVar(&common.RuleExpiryInterval, "ruleExpiry", 60, "interval in seconds for removing stale NAT rules")
+	flag.IntVar(&common.JumpChainRefresh, "jumpRefresh", 300, "interval in seconds for verifying chain jump rule positions")
 	flag.BoolVar(&common.DryRun, "dryRun", false, "execute iptables commands or print only")
 	flag.StringVar(&common.RestrictedPorts, "restrictedPorts", "22,53,6443", "restricted ports refused for NAT rule")
 	flag.StringVar(&common.FirewallFlavor, "firewallFlavor", "iptables", "firewall implementation to use for NAT setup")
 	flag.StringVar(&common.IptablesJump, "iptablesJump", "-2,-2,-2", "rule pos for chain jump to podnat (FORWARD,PREROUTING,POSTROUTING)")
+	flag.StringVar(&common.CNIIntegration, "cniIntegration", "none", "place jumps next to the CNI plugin jumps (none, auto, cilium, calico)")
+	flag.StringVar(&common.CNIJumpPlacement, "cniJumpPlacement", "before", "place jumps before or after the CNI plugin jumps")
+	flag.IntVar(&common.CNIRefresh, "cniRefresh", 2, "interval in seconds for verifying jump positions with CNI integration")
+	flag.IntVar(&common.ChainWatchInterval, "chainWatch", 2, "interval in seconds for detecting changed chains and jumps (0 disables)")
+	flag.StringVar(&common.EBPFInterface, "ebpfInterface", "", "interface for the ebpf tc programs (auto detect from public IP if empty)")
+	flag.StringVar(&common.EBPFObject, "ebpfObject", "/usr/lib/podnat-controller/podnat.o", "object file with the ebpf tc programs")
+	flag.StringVar(&common.EBPFPinPath, "ebpfPinPath", "/sys/fs/bpf/podnat", "bpffs directory for the pinned ebpf maps")
+	flag.StringVar(&common.InternalNetworks, "internalNetworks", "172.16.0.0/12,192.168.0.0/16,10.0.0.0/8,127.0.0.0/8", "comma separated networks exempt from source NAT")
+	flag.BoolVar(&common.DiscoverNetworks, "discoverInternalNetworks", false, "add node pod CIDRs and the service CIDR to the internal networks")
 	flag.StringVar(&common.IncludeFilterNetworks, "inclFilterNet", "", "disable networks during auto detection")
 	flag.StringVar(&common.ExcludeFilterNetworks, "exclFilterNet", "", "enable networks during auto detection (e.g. RFC1918)")
 	flag.StringVar(&common.ResourcePrefix, "resourcePrefix", "podnat", "resource prefix used for firewall chains and comments")
 	flag.StringVar(&common.NodeID, "nodeID", common.ShortHostName(common.GetEnv("HOSTNAME", "node")), "k8s node identifier")
+	flag.StringVar(&common.NodeName, "nodeName", common.GetEnv("NODE_NAME", ""), "k8s node name for server side pod filtering (all pods if empty)")
+	flag.StringVar(&common.PodLabelSelector, "podLabelSelector", "", "label selector for pods watched by the informer")
+	flag.BoolVar(&common.WatchServices, "watchServices", false, "watch service annotations and NAT to a local ready endpoint")
+	flag.StringVar(&common.ServiceLabelSelector, "serviceLabelSelector", "", "label selector for services watched with -watchServices")
+	flag.StringVar(&common.FloatingIPInterface, "floatingIPInterface", "", "interface for floating IPs (auto detect from public IP if empty)")
 	flag.StringVar(&common.StateFlavor, "stateFlavor", "configmap", "state implementation to save iptables rules")
+	flag.StringVar(&common.StateURI, "stateUri", "http://podnat-state-store:80", "URI of the webdav state server")
+	flag.StringVar(&common.StateSecretDir, "stateSecretDir", "", "mounted secret with username and password or token (and ca.crt) for the webdav state")
+	flag.StringVar(&common.StateCAFile, "stateCAFile", "", "CA bundle to verify the webdav state server (default ca.crt of the secret)")
+	flag.IntVar(&common.StateTimeout, "stateTimeout", 10, "timeout in seconds of webdav state requests")
+	flag.IntVar(&common.StateRetries, "stateRetries", 3, "retries of failed webdav state requests")
+	flag.StringVar(&common.EtcdEndpoints, "etcdEndpoints", "http://127.0.0.1:2379", "comma separated etcd endpoints for the etcd state")
+	flag.StringVar(&common.EtcdPrefix, "etcdPrefix", "/podnat/state", "etcd key prefix for the per node state")
+	flag.StringVar(&common.StateDirectory, "stateDir", "/var/lib/podnat-controller", "directory (e.g. hostPath) for the file state")
+	flag.IntVar(&common.StateFlushInterval, "stateFlush", 60, "seconds between writes of state changes that only refresh rules")
+	flag.StringVar(&common.KubeConfig, "kubeconfig", common.GetEnv("KUBECONFIG", ""), "kubeconfig file (in-cluster config if empty)")
+	flag.Float64Var(&kubeQPS, "kubeQPS", 20, "queries per second to the kubernetes API server")
+	flag.IntVar(&common.KubeBurst, "kubeBurst", 30, "burst of queries to the kubernetes API server")
+	flag.StringVar(&common.ConfigFile, "config", "", "YAML or JSON config file with settings and per node overrides")
+	flag.IntVar(&common.ConfigReloadInterval, "configReload", 30, "interval in seconds for checking the config file for changes")
+	flag.StringVar(&common.ShutdownPolicy, "shutdownPolicy", "keep", "keep or cleanup (remove all chains and jumps) rules on SIGTERM")
 	flag.Parse()
+	common.KubeQPS = float32(kubeQPS)
 }
 
-func main() {
-	events := make(chan *api.PodInfo)
+// kubeClients creates the shared kubernetes clients on first use, the
+// subcommands only need them for the configmap and crd state
+func kubeClients() *kube.Clients {
+	if clients == nil {
+		var err error
+		if clients, err = kube.NewClients(common.KubeConfig); err != nil {
+			klog.Errorf("%v\n", err)
+			os.Exit(1)
+		}
+	}
+	return clients
+}
 
-	podInformer := controller.NewPodInformer([]string{"add", "update", "delete"}, events)
-	go podInformer.Run()
+// nodeLabels selects the per node settings of the config file
+func nodeLabels() map[string]string {
+	if common.NodeName == "" {
+		klog.Warningf("node name not set, per node config settings are ignored\n")
+		return nil
+	}
+	node, err := kubeClients().Kubernetes.CoreV1().Nodes().Get(context.TODO(), common.NodeName, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("could not get node %s, per node config settings are ignored: %v\n", common.NodeName, err)
+		return nil
+	}
+	return node.Labels
+}
 
-	httpServer := http.NewHTTPServer()
-	go httpServer.Run()
+// flags given on the command line win over the config file
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
 
+func newStateStore() (state.StateStore, error) {
 	switch common.StateFlavor {
 	case "webdav":
-		fwState = state.NewWebDavState()
+		return state.NewWebDavState()
+	case "etcd":
+		return state.NewEtcdState()
+	case "file":
+		return state.NewFileState()
+	case "crd":
+		return state.NewCRDState(kubeClients().Dynamic, kubeClients().Kubernetes), nil
 	default:
-		fwState = state.NewConfigMapState()
+		return state.NewConfigMapState(kubeClients().Kubernetes), nil
+	}
+}
+
+func main() {
+	// subcommands for inspection and repair, without one the controller runs
+	switch flag.Arg(0) {
+	case "render":
+		os.Exit(runRender(flag.Args()[1:]))
+	case "state":
+		os.Exit(runState(flag.Args()[1:]))
+	case "cleanup":
+		os.Exit(runCleanup(flag.Args()[1:]))
+	}
+
+	var configWatcher *config.Watcher
+	if common.ConfigFile != "" {
+		configWatcher = &config.Watcher{
+			Path:     common.ConfigFile,
+			Labels:   nodeLabels(),
+			Explicit: explicitFlags(),
+			Interval: time.Duration(common.ConfigReloadInterval) * time.Second,
+		}
+		if err := configWatcher.Load(); err != nil {
+			klog.Errorf("could not load config %s: %v\n", common.ConfigFile, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := common.ValidateIntervals(); err != nil {
+		klog.Errorf("invalid interval configuration: %v\n", err)
+		os.Exit(1)
+	}
+	if err := common.ValidateShutdownPolicy(); err != nil {
+		klog.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := common.ValidateIptablesJump(); err != nil {
+		klog.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := common.ValidateInternalNetworks(); err != nil {
+		klog.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	if err := common.ValidateCNIIntegration(); err != nil {
+		klog.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	if common.DiscoverNetworks {
+		networks, err := kube.DiscoverInternalNetworks(kubeClients().Kubernetes)
+		if err != nil {
+			klog.Errorf("discovering internal networks failed: %v\n", err)
+			os.Exit(1)
+		}
+		klog.Infof("discovered internal networks %v\n", networks)
+		common.DiscoveredNetworks = networks
+	}
+
+	// SIGTERM stops the informers, drains the event queue and shuts down
+	// according to the shutdown policy
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	events := controller.NewEventQueue()
+	var informers sync.WaitGroup
+
+	podInformer, err := controller.NewPodInformer(kubeClients().Kubernetes, []string{"add", "update", "delete"}, events)
+	if err != nil {
+		klog.Errorf("%v\n", err)
+		os.Exit(1)
 	}
+	informers.Add(1)
+	go func() {
+		defer informers.Done()
+		podInformer.Run(ctx)
+	}()
 
+	if common.WatchServices {
+		serviceInformer, err := controller.NewServiceInformer(kubeClients().Kubernetes, events)
+		if err != nil {
+			klog.Errorf("%v\n", err)
+			os.Exit(1)
+		}
+		informers.Add(1)
+		go func() {
+			defer informers.Done()
+			serviceInformer.Run(ctx)
+		}()
+	}
+
+	httpServer := http.NewHTTPServer()
+	go httpServer.Run()
+
+	// rule refreshes are written every flush interval, changes immediately
+	store, err := newStateStore()
+	if err != nil {
+		klog.Errorf("%v\n", err)
+		os.Exit(1)
+	}
+	stateWriter := state.NewWriteBehindState(store, time.Duration(common.StateFlushInterval)*time.Second)
+	fwState = stateWriter
+
+	var iptProc *firewall.IPTablesProcessor
+	var ebpfProc *firewall.EBPFProcessor
+	var fipManager *floatingip.Manager
 	switch common.FirewallFlavor {
 	case "iptables":
 		// XXX: with iptables we need a state to survive pod/node restarts
-		fwProc = firewall.NewIpTablesProcessor(fwState, false)
+		iptProc = firewall.NewIpTablesProcessor(fwState, false)
+		httpServer.AddJSONHandler("/plan", func() interface{} { return iptProc.Plan() })
+		fwProc = iptProc
+	case "ebpf":
+		var err error
+		ebpfProc, err = firewall.NewEBPFProcessor(fwState)
+		if err != nil {
+			klog.Errorf("ebpf setup failed: %v\n", err)
+			os.Exit(1)
+		}
+		fwProc = ebpfProc
 	default:
 		fwProc = firewall.NewDummyProcessor()
 	}
+	if iptProc != nil || ebpfProc != nil {
+		var err error
+		fipManager, err = floatingip.NewManager(kubeClients().Kubernetes, common.FloatingIPInterface)
+		if err != nil {
+			klog.Warningf("floating IP support disabled: %v\n", err)
+		} else {
+			fwProc = floatingip.NewProcessor(fwProc, fipManager)
+		}
+	}
 
-	for {
-		podNatEvent := <-events
-		_ = fwProc.Apply(podNatEvent)
+	// settings are only written while the processors hold their locks, the
+	// dummy processor reads none of them
+	reconfigure := func(apply func() error) error { return apply() }
+	if iptProc != nil {
+		reconfigure = iptProc.Reconfigure
+	}
+	if ebpfProc != nil {
+		reconfigure = ebpfProc.Reconfigure
+	}
+	if fipManager != nil {
+		// the manager picks up the settings while the processor holds its lock
+		processorReconfigure := reconfigure
+		reconfigure = func(apply func() error) error {
+			return processorReconfigure(func() error { return fipManager.Reconfigure(apply) })
+		}
+	}
+	if configWatcher != nil {
+		go configWatcher.Run(ctx, reconfigure)
+	}
+	// etcd notifies about changes of others, other stores merge them on the
+	// next conflicting write
+	if etcdStore, ok := store.(*state.EtcdState); ok {
+		if iptProc != nil {
+			go iptProc.WatchState(etcdStore.Watch(ctx))
+		}
+		if ebpfProc != nil {
+			go ebpfProc.WatchState(etcdStore.Watch(ctx))
+		}
+	}
+	if common.DiscoverNetworks {
+		go kube.WatchInternalNetworks(ctx, kubeClients().Kubernetes, reconfigure)
+	}
+
+	go func() {
+		<-ctx.Done()
+		klog.Infof("shutting down, processing remaining events\n")
+		informers.Wait()
+		events.Drain()
+	}()
+	events.Run(fwProc.Apply)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		klog.Warningf("http server shutdown failed: %v\n", err)
+	}
+	if iptProc != nil {
+		iptProc.Shutdown()
+	}
+	if ebpfProc != nil {
+		ebpfProc.Shutdown()
+	}
+	if err := stateWriter.Shutdown(); err != nil {
+		klog.Warningf("could not flush state: %v\n", err)
+	}
+	// floating IPs are released with any policy, another node takes over
+	// the lease once it is no longer renewed
+	if fipManager != nil {
+		klog.Infof("releasing floating IPs\n")
+		fipManager.Shutdown()
+	}
+	if iptProc != nil {
+		if common.ShutdownPolicy == "cleanup" {
+			klog.Infof("shutdown policy cleanup, removing all rules\n")
+			if err := iptProc.Cleanup(); err != nil {
+				klog.Errorf("cleanup failed: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if ebpfProc != nil && common.ShutdownPolicy == "cleanup" {
+		klog.Infof("shutdown policy cleanup, removing ebpf programs and maps\n")
+		if err := ebpfProc.Cleanup(); err != nil {
+			klog.Errorf("cleanup failed: %v\n", err)
+			os.Exit(1)
+		}
 	}
+	klog.Infof("shutdown complete\n")
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/firewall"
+	"io"
+	"os"
+
+	"k8s.io/klog/v2"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// manifestPodInfo extracts the annotation of a pod or of the pod template
+// of a workload (deployment, statefulset, ...)
+func manifestPodInfo(obj map[string]interface{}, podIP string) (*api.PodInfo, error) {
+	u := unstructured.Unstructured{Object: obj}
+	annotations := u.GetAnnotations()
+	if u.GetKind() != "Pod" {
+		annotations, _, _ = unstructured.NestedStringMap(obj, "spec", "template", "metadata", "annotations")
+	}
+	data, ok := annotations[common.AnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	annotation, err := api.ParseAnnotation(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s %s has invalid annotation: %v", u.GetKind(), u.GetName(), err))
+	}
+	if ip, _, _ := unstructured.NestedString(obj, "status", "podIP"); ip != "" {
+		podIP = ip
+	}
+	info := &api.PodInfo{
+		Event:      "add",
+		Name:       u.GetName(),
+		Namespace:  u.GetNamespace(),
+		Annotation: annotation,
+		IPv4:       common.ParseIP(podIP),
+	}
+	if info.Namespace == "" {
+		info.Namespace = "default"
+	}
+	if info.IPv4 == nil {
+		return nil, errors.New(fmt.Sprintf("invalid pod IP %s for %s %s", podIP, u.GetKind(), u.GetName()))
+	}
+	return info, nil
+}
+
+func readManifests(r io.Reader, podIP string) ([]*api.PodInfo, error) {
+	var infos []*api.PodInfo
+	decoder := yaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var obj map[string]interface{}
+		if err := decoder.Decode(&obj); err != nil {
+			if err == io.EOF {
+				return infos, nil
+			}
+			return nil, err
+		}
+		// empty documents between separators
+		if obj == nil {
+			continue
+		}
+		info, err := manifestPodInfo(obj, podIP)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			infos = append(infos, info)
+		}
+	}
+}
+
+// runRender prints the rules for the annotations in the given manifests
+// without touching the kernel
+func runRender(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	nodeIP := fs.String("nodeIP", "203.0.113.1", "public node IP used for entries without srcIP")
+	podIP := fs.String("podIP", "10.0.0.1", "pod IP for manifests without status.podIP")
+	format := fs.String("format", "rules", "output format, rules (iptables commands) or restore (iptables-restore)")
+	fs.StringVar(&common.AnnotationKey, "annotationKey", common.AnnotationKey, "pod annotation key for iptables NAT trigger")
+	fs.StringVar(&common.ResourcePrefix, "resourcePrefix", common.ResourcePrefix, "resource prefix used for firewall chains and comments")
+	fs.StringVar(&common.RestrictedPorts, "restrictedPorts", common.RestrictedPorts, "restricted ports refused for NAT rule")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s render [flags] manifest...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	publicIP := common.ParseIP(*nodeIP)
+	if publicIP == nil {
+		klog.Errorf("invalid node IP %s\n", *nodeIP)
+		return 1
+	}
+
+	renderer := firewall.NewIpTablesRenderer(publicIP)
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			klog.Errorf("could not open manifest: %v\n", err)
+			return 1
+		}
+		infos, err := readManifests(f, *podIP)
+		f.Close()
+		if err != nil {
+			klog.Errorf("could not read manifest %s: %v\n", path, err)
+			return 1
+		}
+		for _, info := range infos {
+			if err := renderer.Apply(info); err != nil {
+				klog.Errorf("could not render %s: %v\n", info.Name, err)
+				return 1
+			}
+		}
+	}
+
+	if err := renderer.Render(os.Stdout, *format); err != nil {
+		klog.Errorf("%v\n", err)
+		return 2
+	}
+	return 0
+}
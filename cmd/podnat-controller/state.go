@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/firewall"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+func printState(st *state.State) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// printDiff prints rules missing in the kernel with + and rules not backed
+// by the state with -, returns true if there are differences
+func printDiff(plan *firewall.Plan) bool {
+	var names []string
+	for name := range plan.Chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changed := false
+	for _, name := range names {
+		c := plan.Chains[name]
+		if len(c.Add) == 0 && len(c.Delete) == 0 {
+			continue
+		}
+		changed = true
+		fmt.Printf("%s/%s\n", c.Table, name)
+		for _, rule := range c.Add {
+			fmt.Printf("+ %s\n", strings.Join(rule, " "))
+		}
+		for _, rule := range c.Delete {
+			fmt.Printf("- %s\n", strings.Join(rule, " "))
+		}
+	}
+	return changed
+}
+
+// runState inspects and repairs the state of a node, a running controller
+// merges the changes into its rules on the next state write
+func runState(args []string) int {
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	fs.StringVar(&common.NodeID, "nodeID", common.NodeID, "k8s node identifier of the state")
+	fs.StringVar(&common.StateFlavor, "stateFlavor", common.StateFlavor, "state implementation to save iptables rules")
+	fs.StringVar(&common.ResourcePrefix, "resourcePrefix", common.ResourcePrefix, "resource prefix used for firewall chains and comments")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s state get|put <file>|diff|prune <key>... [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		return 2
+	}
+	action := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	store, err := newStateStore()
+	if err != nil {
+		klog.Errorf("%v\n", err)
+		return 1
+	}
+
+	switch action {
+	case "get":
+		st, err := store.Load()
+		if err != nil {
+			klog.Errorf("could not read state of node %s: %v\n", common.NodeID, err)
+			return 1
+		}
+		if err := printState(st); err != nil {
+			klog.Errorf("could not encode state: %v\n", err)
+			return 1
+		}
+	case "put":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		var data []byte
+		var err error
+		if fs.Arg(0) == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(fs.Arg(0))
+		}
+		if err != nil {
+			klog.Errorf("could not read state file: %v\n", err)
+			return 1
+		}
+		// state files of older versions are migrated
+		st, err := state.Decode(data)
+		if err != nil {
+			klog.Errorf("state file malformed: %v\n", err)
+			return 1
+		}
+		st.NodeID = common.NodeID
+		current, err := store.Load()
+		switch {
+		case err == nil:
+			st.Revision = current.Revision
+		case !errors.Is(err, state.ErrNotFound):
+			klog.Errorf("could not read state of node %s: %v\n", common.NodeID, err)
+			return 1
+		}
+		if err := store.Save(st); err != nil {
+			klog.Errorf("could not write state of node %s: %v\n", common.NodeID, err)
+			return 1
+		}
+	case "diff":
+		inspector, err := firewall.NewIpTablesInspector(store)
+		if err != nil {
+			klog.Errorf("%v\n", err)
+			return 1
+		}
+		plan, err := inspector.Diff()
+		if err != nil {
+			klog.Errorf("could not compare state with iptables: %v\n", err)
+			return 1
+		}
+		if printDiff(plan) {
+			return 1
+		}
+	case "prune":
+		if fs.NArg() == 0 {
+			fs.Usage()
+			return 2
+		}
+		st, err := store.Load()
+		if err != nil {
+			klog.Errorf("could not read state of node %s: %v\n", common.NodeID, err)
+			return 1
+		}
+		for _, key := range fs.Args() {
+			if _, ok := st.Rules[key]; !ok {
+				klog.Errorf("key %s not found in state of node %s\n", key, common.NodeID)
+				return 1
+			}
+			delete(st.Rules, key)
+		}
+		// fails if the controller wrote the state in between
+		if err := store.Save(st); err != nil {
+			klog.Errorf("could not write state of node %s: %v\n", common.NodeID, err)
+			return 1
+		}
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
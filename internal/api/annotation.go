@@ -18,10 +18,15 @@ func (c *NATDefinition) UnmarshalJSON(data []byte) error {
 		SourcePort          uint16  `json:"srcPort"`
 		DestinationPort     uint16  `json:"dstPort"`
 		Protocol            string  `json:"proto"`
+		Balance             string  `json:"balance"`
+		Weight              uint16  `json:"weight"`
+		Sticky              uint32  `json:"sticky"`
+		Floating            bool    `json:"floating"`
 	}{
 		InterfaceAutoDetect: true,
 		SourceIP:            nil,
 		Protocol:            "tcp",
+		Weight:              1,
 	}
 	if err := json.Unmarshal(data, pd); err != nil {
 		return err
@@ -31,6 +36,10 @@ func (c *NATDefinition) UnmarshalJSON(data []byte) error {
 	c.SourcePort = pd.SourcePort
 	c.DestinationPort = pd.DestinationPort
 	c.Protocol = pd.Protocol
+	c.Balance = pd.Balance
+	c.Weight = pd.Weight
+	c.Sticky = pd.Sticky
+	c.Floating = pd.Floating
 
 	return nil
 }
@@ -60,16 +69,37 @@ func ParseAnnotation(data string) (*PodNATAnnotation, error) {
 			return nil, errors.New("supported protocols for NAT entries are 'tcp' and 'udp'")
 		}
 
-		if common.RestrictedPorts == "" {
+		if def.Balance != "" && def.Balance != "random" && def.Balance != "nth" {
+			return nil, errors.New("supported balance modes for NAT entries are 'random' and 'nth'")
+		}
+
+		if def.Balance != "" && common.FirewallFlavor == "ebpf" {
+			return nil, errors.New("balance modes are not supported by the ebpf firewall flavor")
+		}
+
+		if def.Weight == 0 {
+			return nil, errors.New("weight 0 is not allowed, remove the entry instead")
+		}
+
+		if def.Floating && def.SourceIP == nil {
+			return nil, errors.New("floating IP requires a manual SourceIP for entry")
+		}
+
+		if def.Sticky > 0 && def.Balance == "" {
+			return nil, errors.New("sticky sessions are only supported with balance mode enabled")
+		}
+
+		restrictedPorts := common.GetRestrictedPorts()
+		if restrictedPorts == "" {
 			continue
 		}
 
-		_restrictedPorts, _ := common.SliceAtoi(strings.Split(common.RestrictedPorts, ","))
+		_restrictedPorts, _ := common.SliceAtoi(strings.Split(restrictedPorts, ","))
 		if slices.Contains(_restrictedPorts, def.SourcePort) || slices.Contains(_restrictedPorts, def.DestinationPort) {
 			return nil, errors.New(
 				fmt.Sprintf(
 					"restricted ports %v are not allowed by default",
-					common.RestrictedPorts,
+					restrictedPorts,
 				),
 			)
 		}
@@ -15,9 +15,9 @@ func TestGoodAnnotationJSON(t *testing.T) {
 	]}`
 	expectedOutput := &PodNATAnnotation{
 		TableEntries: []NATDefinition{
-			{InterfaceAutoDetect: true, SourceIP: nil, SourcePort: 25, DestinationPort: 25, Protocol: "tcp"},
-			{InterfaceAutoDetect: false, SourceIP: common.Ptr("192.168.1.10"), SourcePort: 143, DestinationPort: 143, Protocol: "tcp"},
-			{InterfaceAutoDetect: true, SourceIP: nil, SourcePort: 8888, DestinationPort: 18888, Protocol: "udp"},
+			{InterfaceAutoDetect: true, SourceIP: nil, SourcePort: 25, DestinationPort: 25, Protocol: "tcp", Weight: 1},
+			{InterfaceAutoDetect: false, SourceIP: common.Ptr("192.168.1.10"), SourcePort: 143, DestinationPort: 143, Protocol: "tcp", Weight: 1},
+			{InterfaceAutoDetect: true, SourceIP: nil, SourcePort: 8888, DestinationPort: 18888, Protocol: "udp", Weight: 1},
 		},
 	}
 
@@ -42,3 +42,47 @@ func TestBadPortAnnotationJSON(t *testing.T) {
 		t.Fatal("Expected error 'port 0 is reserved and cannot be used' but got", err)
 	}
 }
+
+func TestBalanceAnnotationJSON(t *testing.T) {
+	input := `{"entries":[
+	{"srcPort":27015,"dstPort":27015,"proto":"udp","balance":"random","weight":3,"sticky":300}
+	]}`
+	expectedOutput := &PodNATAnnotation{
+		TableEntries: []NATDefinition{
+			{InterfaceAutoDetect: true, SourcePort: 27015, DestinationPort: 27015, Protocol: "udp", Balance: "random", Weight: 3, Sticky: 300},
+		},
+	}
+
+	out, err := ParseAnnotation(input)
+	if err != nil {
+		t.Fatal("Failure message", err)
+	}
+
+	if !reflect.DeepEqual(expectedOutput, out) {
+		t.Fatal("Actual output does not match expected output")
+	}
+}
+
+func TestBadOptionAnnotationJSON(t *testing.T) {
+	for input, expected := range map[string]string{
+		`{"entries":[{"srcPort":25,"dstPort":25,"balance":"roundrobin"}]}`: "supported balance modes for NAT entries are 'random' and 'nth'",
+		`{"entries":[{"srcPort":25,"dstPort":25,"sticky":60}]}`:            "sticky sessions are only supported with balance mode enabled",
+		`{"entries":[{"srcPort":25,"dstPort":25,"weight":0}]}`:             "weight 0 is not allowed, remove the entry instead",
+		`{"entries":[{"srcPort":25,"dstPort":25,"floating":true}]}`:        "floating IP requires a manual SourceIP for entry",
+	} {
+		_, err := ParseAnnotation(input)
+		if err == nil || err.Error() != expected {
+			t.Fatalf("Expected error '%s' but got %v", expected, err)
+		}
+	}
+}
+
+func TestBalanceAnnotationRejectedByEBPF(t *testing.T) {
+	flavor := common.FirewallFlavor
+	common.FirewallFlavor = "ebpf"
+	defer func() { common.FirewallFlavor = flavor }()
+	_, err := ParseAnnotation(`{"entries":[{"srcPort":27015,"dstPort":27015,"proto":"udp","balance":"random"}]}`)
+	if err == nil || err.Error() != "balance modes are not supported by the ebpf firewall flavor" {
+		t.Fatalf("Expected error for balance with ebpf but got %v", err)
+	}
+}
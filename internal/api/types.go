@@ -25,6 +25,10 @@ type NATDefinition struct {
 	SourcePort          uint16  `json:"srcPort"`
 	DestinationPort     uint16  `json:"dstPort"`
 	Protocol            string  `json:"proto"`
+	Balance             string  `json:"balance"`
+	Weight              uint16  `json:"weight"`
+	Sticky              uint32  `json:"sticky"`
+	Floating            bool    `json:"floating"`
 }
 
 type NATRule struct {
@@ -36,4 +40,7 @@ type NATRule struct {
 	LastVerified    time.Time   `json:"LastVerified"`
 	Created         time.Time   `json:"Created"`
 	Comment         string      `json:"Comment"`
+	Balance         string      `json:"Balance,omitempty"`
+	Weight          uint16      `json:"Weight,omitempty"`
+	Sticky          uint32      `json:"Sticky,omitempty"`
 }
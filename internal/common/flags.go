@@ -1,16 +1,161 @@
 package common
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
 var (
 	DryRun                bool
 	ResourcePrefix        string
 	AnnotationKey         string
 	HTTPPort              int
 	InformerResync        int
+	RuleStaleness         int
+	RuleExpiryInterval    int
+	JumpChainRefresh      int
 	RestrictedPorts       string
 	FirewallFlavor        string
 	IptablesJump          string
 	IncludeFilterNetworks string
 	ExcludeFilterNetworks string
 	NodeID                string
+	NodeName              string
+	PodLabelSelector      string
+	WatchServices         bool
+	ServiceLabelSelector  string
+	FloatingIPInterface   string
 	StateFlavor           string
+	ShutdownPolicy        string
+	EtcdEndpoints         string
+	EtcdPrefix            string
+	StateDirectory        string
+	StateFlushInterval    int
+	StateURI              string
+	StateSecretDir        string
+	StateCAFile           string
+	StateTimeout          int
+	StateRetries          int
+	KubeConfig            string
+	KubeQPS               float32
+	KubeBurst             int
+	ConfigFile            string
+	ConfigReloadInterval  int
+	InternalNetworks      string
+	DiscoverNetworks      bool
+	DiscoveredNetworks    []string
+	CNIIntegration        string
+	CNIJumpPlacement      string
+	CNIRefresh            int
+	ChainWatchInterval    int
+	EBPFInterface         string
+	EBPFObject            string
+	EBPFPinPath           string
 )
+
+// annotations are parsed by the informers while a config reload swaps the
+// restricted ports
+var restrictedPortsMutex sync.RWMutex
+
+// SetRestrictedPorts replaces the restricted ports, e.g. on config reload
+func SetRestrictedPorts(ports string) {
+	restrictedPortsMutex.Lock()
+	defer restrictedPortsMutex.Unlock()
+	RestrictedPorts = ports
+}
+
+// GetRestrictedPorts returns the restricted ports, safe to call while
+// they are replaced
+func GetRestrictedPorts() string {
+	restrictedPortsMutex.RLock()
+	defer restrictedPortsMutex.RUnlock()
+	return RestrictedPorts
+}
+
+// rules are refreshed by informer update events only, so a rule must live
+// longer than one resync cycle, otherwise valid rules expire between syncs
+func ValidateIntervals() error {
+	if InformerResync <= 0 || RuleStaleness <= 0 || RuleExpiryInterval <= 0 || JumpChainRefresh <= 0 || StateFlushInterval <= 0 {
+		return errors.New("intervals for informer resync, rule staleness, rule expiry, jump refresh and state flush must be positive")
+	}
+	if RuleStaleness <= InformerResync {
+		return errors.New(
+			fmt.Sprintf(
+				"rule staleness (%ds) must be greater than informer resync interval (%ds)",
+				RuleStaleness,
+				InformerResync,
+			),
+		)
+	}
+	if ChainWatchInterval < 0 {
+		return errors.New("chain watch interval must not be negative")
+	}
+	if RuleExpiryInterval > RuleStaleness {
+		return errors.New(
+			fmt.Sprintf(
+				"rule expiry interval (%ds) must not be greater than rule staleness (%ds)",
+				RuleExpiryInterval,
+				RuleStaleness,
+			),
+		)
+	}
+	return nil
+}
+
+// on shutdown the rules are either kept for the next controller start or
+// removed, e.g. for uninstalling
+func ValidateShutdownPolicy() error {
+	if ShutdownPolicy != "keep" && ShutdownPolicy != "cleanup" {
+		return errors.New(fmt.Sprintf("unknown shutdown policy %s, use keep or cleanup", ShutdownPolicy))
+	}
+	return nil
+}
+
+// jump positions are given for FORWARD, PREROUTING and POSTROUTING
+func ValidateIptablesJump() error {
+	positions := strings.Split(IptablesJump, ",")
+	if len(positions) != 3 {
+		return errors.New(fmt.Sprintf("iptables jump %s must have three positions (FORWARD,PREROUTING,POSTROUTING)", IptablesJump))
+	}
+	for _, pos := range positions {
+		if _, err := strconv.ParseInt(pos, 10, 16); err != nil {
+			return errors.New(fmt.Sprintf("invalid iptables jump position %s: %v", pos, err))
+		}
+	}
+	return nil
+}
+
+// traffic to internal networks is not source NATed, the networks are
+// given as CIDR like iptables -S prints them
+func ValidateInternalNetworks() error {
+	for _, n := range strings.Split(InternalNetworks, ",") {
+		if n == "" {
+			continue
+		}
+		if _, ipNet, err := net.ParseCIDR(n); err != nil || ipNet.String() != n {
+			return errors.New(fmt.Sprintf("internal network %s is not a CIDR network address", n))
+		}
+	}
+	return nil
+}
+
+// with CNI integration the jumps are placed next to the jumps of the CNI
+// plugin (auto detected from its chains) instead of numeric positions
+func ValidateCNIIntegration() error {
+	switch CNIIntegration {
+	case "none", "auto", "cilium", "calico":
+	default:
+		return errors.New(fmt.Sprintf("unknown CNI integration %s, use none, auto, cilium or calico", CNIIntegration))
+	}
+	if CNIJumpPlacement != "before" && CNIJumpPlacement != "after" {
+		return errors.New(fmt.Sprintf("unknown CNI jump placement %s, use before or after", CNIJumpPlacement))
+	}
+	if CNIRefresh <= 0 {
+		return errors.New("CNI jump refresh interval must be positive")
+	}
+	return nil
+}
@@ -106,6 +106,31 @@ func GetPublicIPAddress(version uint8) (*net.IPAddr, error) {
 	return nil, nil
 }
 
+// PublicInterface returns the name of the interface holding the public
+// node IP
+func PublicInterface() (string, error) {
+	publicIP, _ := GetPublicIPAddress(4)
+	if publicIP == nil {
+		return "", errors.New("could not detect public node IP")
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(publicIP.IP) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", errors.New("no interface found for public node IP " + publicIP.String())
+}
+
 func getFilteredNetworks(exclude, include string) []string {
 	excludeFromFilter := strings.Split(exclude, ",")
 	includeInFilter := strings.Split(include, ",")
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"os"
+
+	"k8s.io/klog/v2"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Settings are the flags which can be set in the config file, unset
+// fields keep the flag value. Names match the flags.
+type Settings struct {
+	InformerResync   *int    `json:"informerResync,omitempty"`
+	RuleStaleness    *int    `json:"ruleStaleness,omitempty"`
+	RuleExpiry       *int    `json:"ruleExpiry,omitempty"`
+	JumpRefresh      *int    `json:"jumpRefresh,omitempty"`
+	IptablesJump     *string `json:"iptablesJump,omitempty"`
+	RestrictedPorts  *string `json:"restrictedPorts,omitempty"`
+	InternalNetworks *string `json:"internalNetworks,omitempty"`
+}
+
+// NodeSettings override the settings on nodes matching all labels of the
+// node selector, later entries win
+type NodeSettings struct {
+	NodeSelector map[string]string `json:"nodeSelector"`
+	Settings     `json:",inline"`
+}
+
+type Config struct {
+	Settings `json:",inline"`
+	Nodes    []NodeSettings `json:"nodes,omitempty"`
+}
+
+// setting binds a config field to its flag and global, restart marks
+// settings only read on start
+type setting struct {
+	name    string
+	restart bool
+	get     func(s *Settings) interface{}
+	apply   func(value interface{})
+	current func() interface{}
+}
+
+var settings = []setting{
+	{
+		name:    "informerResync",
+		restart: true,
+		get:     func(s *Settings) interface{} { return deref(s.InformerResync) },
+		apply:   func(v interface{}) { common.InformerResync = v.(int) },
+		current: func() interface{} { return common.InformerResync },
+	},
+	{
+		name:    "ruleStaleness",
+		get:     func(s *Settings) interface{} { return deref(s.RuleStaleness) },
+		apply:   func(v interface{}) { common.RuleStaleness = v.(int) },
+		current: func() interface{} { return common.RuleStaleness },
+	},
+	{
+		name:    "ruleExpiry",
+		get:     func(s *Settings) interface{} { return deref(s.RuleExpiry) },
+		apply:   func(v interface{}) { common.RuleExpiryInterval = v.(int) },
+		current: func() interface{} { return common.RuleExpiryInterval },
+	},
+	{
+		name:    "jumpRefresh",
+		get:     func(s *Settings) interface{} { return deref(s.JumpRefresh) },
+		apply:   func(v interface{}) { common.JumpChainRefresh = v.(int) },
+		current: func() interface{} { return common.JumpChainRefresh },
+	},
+	{
+		name:    "iptablesJump",
+		get:     func(s *Settings) interface{} { return deref(s.IptablesJump) },
+		apply:   func(v interface{}) { common.IptablesJump = v.(string) },
+		current: func() interface{} { return common.IptablesJump },
+	},
+	{
+		name:    "restrictedPorts",
+		get:     func(s *Settings) interface{} { return deref(s.RestrictedPorts) },
+		apply:   func(v interface{}) { common.SetRestrictedPorts(v.(string)) },
+		current: func() interface{} { return common.GetRestrictedPorts() },
+	},
+	{
+		name:    "internalNetworks",
+		get:     func(s *Settings) interface{} { return deref(s.InternalNetworks) },
+		apply:   func(v interface{}) { common.InternalNetworks = v.(string) },
+		current: func() interface{} { return common.InternalNetworks },
+	},
+}
+
+// deref returns nil for unset fields
+func deref[T any](p *T) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// merge sets the fields set in o
+func (s *Settings) merge(o Settings) {
+	if o.InformerResync != nil {
+		s.InformerResync = o.InformerResync
+	}
+	if o.RuleStaleness != nil {
+		s.RuleStaleness = o.RuleStaleness
+	}
+	if o.RuleExpiry != nil {
+		s.RuleExpiry = o.RuleExpiry
+	}
+	if o.JumpRefresh != nil {
+		s.JumpRefresh = o.JumpRefresh
+	}
+	if o.IptablesJump != nil {
+		s.IptablesJump = o.IptablesJump
+	}
+	if o.RestrictedPorts != nil {
+		s.RestrictedPorts = o.RestrictedPorts
+	}
+	if o.InternalNetworks != nil {
+		s.InternalNetworks = o.InternalNetworks
+	}
+}
+
+// Load reads a YAML or JSON config file, unknown keys are an error
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+func parse(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid config: %v", err))
+	}
+	for i, node := range c.Nodes {
+		if len(node.NodeSelector) == 0 {
+			return nil, errors.New(fmt.Sprintf("invalid config: node settings %d without nodeSelector", i))
+		}
+	}
+	return c, nil
+}
+
+// Resolve returns the settings of a node with the given labels
+func (c *Config) Resolve(nodeLabels map[string]string) Settings {
+	s := c.Settings
+	for _, node := range c.Nodes {
+		if labels.SelectorFromSet(node.NodeSelector).Matches(labels.Set(nodeLabels)) {
+			s.merge(node.Settings)
+		}
+	}
+	return s
+}
+
+// validate checks the globals after applying settings
+func validate() error {
+	if err := common.ValidateIntervals(); err != nil {
+		return err
+	}
+	if err := common.ValidateInternalNetworks(); err != nil {
+		return err
+	}
+	return common.ValidateIptablesJump()
+}
+
+// values returns the current globals of all settings
+func values() map[string]interface{} {
+	v := make(map[string]interface{})
+	for _, st := range settings {
+		v[st.name] = st.current()
+	}
+	return v
+}
+
+// Apply sets the globals from s, flags given on the command line are kept.
+// Settings unset in s fall back to defaults, nil keeps them. On start
+// (initial) all settings are applied, later only settings which take
+// effect without restart. Invalid settings are reverted.
+func Apply(s Settings, explicit map[string]bool, defaults map[string]interface{}, initial bool) error {
+	previous := make(map[string]interface{})
+	for _, st := range settings {
+		value := st.get(&s)
+		if value == nil {
+			value = defaults[st.name]
+		}
+		if value == nil || explicit[st.name] || value == st.current() {
+			continue
+		}
+		if st.restart && !initial {
+			klog.Warningf("config %s changed, takes effect after restart\n", st.name)
+			continue
+		}
+		previous[st.name] = st.current()
+		st.apply(value)
+	}
+	if err := validate(); err != nil {
+		for _, st := range settings {
+			if value, ok := previous[st.name]; ok {
+				st.apply(value)
+			}
+		}
+		return err
+	}
+	return nil
+}
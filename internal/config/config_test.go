@@ -0,0 +1,162 @@
+package config
+
+import (
+	"context"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+ruleStaleness: 900
+iptablesJump: "-2,-2,-2"
+nodes:
+- nodeSelector:
+    cni: cilium
+  iptablesJump: "1,1,-1"
+- nodeSelector:
+    cni: cilium
+    zone: edge
+  jumpRefresh: 60
+`
+
+func setDefaults() {
+	common.InformerResync = 180
+	common.RuleStaleness = 600
+	common.RuleExpiryInterval = 60
+	common.JumpChainRefresh = 300
+	common.StateFlushInterval = 60
+	common.IptablesJump = "-2,-2,-2"
+	common.RestrictedPorts = "22,53,6443"
+	common.InternalNetworks = "10.0.0.0/8"
+}
+
+func TestResolveNodeSettings(t *testing.T) {
+	c, err := parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := c.Resolve(map[string]string{"cni": "calico"})
+	if *s.RuleStaleness != 900 || *s.IptablesJump != "-2,-2,-2" || s.JumpRefresh != nil {
+		t.Fatalf(`settings of calico node = %+v`, s)
+	}
+	s = c.Resolve(map[string]string{"cni": "cilium", "zone": "edge"})
+	if *s.RuleStaleness != 900 || *s.IptablesJump != "1,1,-1" || *s.JumpRefresh != 60 {
+		t.Fatalf(`settings of cilium edge node = %+v`, s)
+	}
+}
+
+func TestParseRejectsInvalidConfig(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown key":      "ruleStale: 900\n",
+		"wrong type":       "ruleStaleness: soon\n",
+		"missing selector": "nodes:\n- iptablesJump: \"1,1,1\"\n",
+	} {
+		if _, err := parse([]byte(data)); err == nil {
+			t.Errorf(`parse() of config with %s succeeded`, name)
+		}
+	}
+	// JSON is valid YAML
+	if _, err := parse([]byte(`{"ruleStaleness": 900, "nodes": [{"nodeSelector": {"cni": "calico"}, "iptablesJump": "1,1,1"}]}`)); err != nil {
+		t.Fatalf(`parse() of JSON config failed: %v`, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	setDefaults()
+	s := Settings{
+		RuleStaleness:   common.Ptr(900),
+		RuleExpiry:      common.Ptr(30),
+		RestrictedPorts: common.Ptr("22"),
+	}
+	// the flag given on the command line wins
+	if err := Apply(s, map[string]bool{"ruleExpiry": true}, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if common.RuleStaleness != 900 || common.RuleExpiryInterval != 60 || common.RestrictedPorts != "22" {
+		t.Fatalf(`globals after apply = %d/%d/%s`, common.RuleStaleness, common.RuleExpiryInterval, common.RestrictedPorts)
+	}
+
+	// settings read on start only are not changed on reload
+	s.InformerResync = common.Ptr(300)
+	s.RestrictedPorts = common.Ptr("22,25")
+	if err := Apply(s, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if common.InformerResync != 180 || common.RestrictedPorts != "22,25" {
+		t.Fatalf(`globals after reload = %d/%s, want 180/22,25`, common.InformerResync, common.RestrictedPorts)
+	}
+	s.InformerResync = nil
+
+	// invalid settings are reverted completely
+	err := Apply(Settings{RuleStaleness: common.Ptr(100), IptablesJump: common.Ptr("1,1,1")}, nil, nil, false)
+	if err == nil {
+		t.Fatalf(`Apply() of staleness below informer resync succeeded`)
+	}
+	if common.RuleStaleness != 900 || common.IptablesJump != "-2,-2,-2" {
+		t.Fatalf(`globals after invalid apply = %d/%s`, common.RuleStaleness, common.IptablesJump)
+	}
+	if err := Apply(Settings{IptablesJump: common.Ptr("1,1")}, nil, nil, false); err == nil {
+		t.Fatalf(`Apply() of two jump positions succeeded`)
+	}
+	// iptables -S prints network addresses, host bits would never match
+	if err := Apply(Settings{InternalNetworks: common.Ptr("10.0.0.0/8,100.64.0.1/10")}, nil, nil, false); err == nil {
+		t.Fatalf(`Apply() of internal network with host bits succeeded`)
+	}
+	if err := Apply(Settings{InternalNetworks: common.Ptr("100.64.0.0/10,fd00::/8")}, nil, nil, false); err != nil || common.InternalNetworks != "100.64.0.0/10,fd00::/8" {
+		t.Fatalf(`Apply() of internal networks = %v, networks %s`, err, common.InternalNetworks)
+	}
+}
+
+// writeConfig replaces the file in one step like a configmap update, the
+// watcher never reads a partially written file
+func writeConfig(t *testing.T, path, data string) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherReload(t *testing.T) {
+	setDefaults()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, testConfig)
+	w := &Watcher{Path: path, Labels: map[string]string{"cni": "cilium"}, Interval: 10 * time.Millisecond}
+	if err := w.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if common.IptablesJump != "1,1,-1" || common.RuleStaleness != 900 {
+		t.Fatalf(`globals after load = %s/%d`, common.IptablesJump, common.RuleStaleness)
+	}
+
+	reloaded := make(chan string, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx, func(apply func() error) error {
+		err := apply()
+		if err == nil {
+			reloaded <- common.IptablesJump
+		}
+		return err
+	})
+
+	// an invalid file keeps the current settings
+	writeConfig(t, path, "ruleStaleness: [\n")
+	time.Sleep(50 * time.Millisecond)
+	// ruleStaleness was removed from the file and falls back to the flag
+	writeConfig(t, path, "nodes:\n- nodeSelector:\n    cni: cilium\n  iptablesJump: \"2,2,2\"\n")
+	select {
+	case jump := <-reloaded:
+		if jump != "2,2,2" || common.RuleStaleness != 600 {
+			t.Fatalf(`globals after reload = %s/%d, want 2,2,2/600`, jump, common.RuleStaleness)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`config was not reloaded`)
+	}
+}
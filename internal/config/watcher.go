@@ -0,0 +1,78 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Watcher reloads the config file when its content changes. Mounted
+// configmaps are updated by swapping a symlink, so the file is polled
+// instead of watched with inotify.
+type Watcher struct {
+	Path     string
+	Labels   map[string]string
+	Explicit map[string]bool
+	Interval time.Duration
+	checksum [32]byte
+	// flag values before the file was applied, keys removed from the
+	// file fall back to them on reload
+	defaults map[string]interface{}
+}
+
+// Load reads and applies the config on start
+func (w *Watcher) Load() error {
+	data, err := os.ReadFile(w.Path)
+	if err != nil {
+		return err
+	}
+	c, err := parse(data)
+	if err != nil {
+		return err
+	}
+	w.defaults = values()
+	if err := Apply(c.Resolve(w.Labels), w.Explicit, nil, true); err != nil {
+		return err
+	}
+	w.checksum = sha256.Sum256(data)
+	return nil
+}
+
+// Run reloads changed config until ctx is done. The settings are applied
+// within reconfigure, which then picks them up, e.g. under a lock of the
+// processor reading them.
+func (w *Watcher) Run(ctx context.Context, reconfigure func(apply func() error) error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.Interval):
+		}
+		data, err := os.ReadFile(w.Path)
+		if err != nil {
+			klog.Warningf("could not read config %s: %v\n", w.Path, err)
+			continue
+		}
+		checksum := sha256.Sum256(data)
+		if checksum == w.checksum {
+			continue
+		}
+		w.checksum = checksum
+		c, err := parse(data)
+		if err != nil {
+			klog.Errorf("keeping current config, %v\n", err)
+			continue
+		}
+		err = reconfigure(func() error {
+			return Apply(c.Resolve(w.Labels), w.Explicit, w.defaults, false)
+		})
+		if err != nil {
+			klog.Errorf("keeping current config, %v\n", err)
+			continue
+		}
+		klog.Infof("reloaded config %s\n", w.Path)
+	}
+}
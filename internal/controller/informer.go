@@ -1,11 +1,12 @@
 package controller
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/gutmensch/podnat-controller/internal/api"
 	"github.com/gutmensch/podnat-controller/internal/common"
-	"k8s.io/client-go/rest"
 	"net"
-	"os"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -13,29 +14,50 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"k8s.io/client-go/tools/clientcmd"
 )
 
 type PodInformer struct {
 	factory kubeinformers.SharedInformerFactory
 }
 
-func (i *PodInformer) Run() {
-	stop := make(chan struct{})
-	defer close(stop)
+// Run starts the informer and blocks until ctx is cancelled and all
+// informer goroutines are stopped.
+func (i *PodInformer) Run(ctx context.Context) {
 	defer runtime.HandleCrash()
-	i.factory.Start(stop)
-	for {
-		time.Sleep(time.Second)
+	i.factory.Start(ctx.Done())
+	<-ctx.Done()
+	i.factory.Shutdown()
+}
+
+// deletions missed during a broken watch are delivered as tombstone
+// carrying the last known pod state
+func podFromObject(data interface{}) *corev1.Pod {
+	switch obj := data.(type) {
+	case *corev1.Pod:
+		return obj
+	case cache.DeletedFinalStateUnknown:
+		if pod, ok := obj.Obj.(*corev1.Pod); ok {
+			return pod
+		}
+		klog.Warningf("ignoring tombstone %s with unexpected object type %T\n", obj.Key, obj.Obj)
+	default:
+		klog.Warningf("ignoring unexpected object type %T\n", data)
 	}
+	return nil
 }
 
 func generatePodInfo(event string, data interface{}) *api.PodInfo {
-	pod := data.(*corev1.Pod)
+	pod := podFromObject(data)
+	if pod == nil {
+		return nil
+	}
 	podName := pod.ObjectMeta.Name
 	podNamespace := pod.ObjectMeta.Namespace
 	podAnnotation, err := api.ParseAnnotation(pod.ObjectMeta.Annotations[common.AnnotationKey])
@@ -56,7 +78,10 @@ func generatePodInfo(event string, data interface{}) *api.PodInfo {
 }
 
 func filterForAnnotationAndPlacement(event string, data interface{}) bool {
-	pod := data.(*corev1.Pod)
+	pod := podFromObject(data)
+	if pod == nil {
+		return false
+	}
 
 	// IP not yet assigned, wait for next update cycle
 	if net.ParseIP(pod.Status.PodIP) == nil {
@@ -83,32 +108,94 @@ func filterForAnnotationAndPlacement(event string, data interface{}) bool {
 	return false
 }
 
-func NewPodInformer(subscriber []string, events chan<- *api.PodInfo) *PodInformer {
-	kubeConfig := common.GetEnv("KUBECONFIG", "")
-	var config *rest.Config
-	var clientSet *kubernetes.Clientset
-	var err error
-	config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
-	if err != nil {
-		klog.Errorln(err)
-		os.Exit(1)
+func equalEntry(a, b api.NATDefinition) bool {
+	if (a.SourceIP == nil) != (b.SourceIP == nil) {
+		return false
 	}
-	clientSet, err = kubernetes.NewForConfig(config)
-	if err != nil {
-		klog.Errorln(err)
-		os.Exit(1)
+	if a.SourceIP != nil && *a.SourceIP != *b.SourceIP {
+		return false
 	}
+	return a.InterfaceAutoDetect == b.InterfaceAutoDetect &&
+		a.SourcePort == b.SourcePort &&
+		a.DestinationPort == b.DestinationPort &&
+		a.Protocol == b.Protocol
+}
 
+// generateRemovalInfo returns a delete event for all NAT entries of the old pod
+// state, which are gone in the new state. this covers removed or edited
+// annotations, changed pod IPs and pods turning unready.
+func generateRemovalInfo(oldObj, newObj interface{}) *api.PodInfo {
+	// old state without active rules, nothing to remove
+	if !filterForAnnotationAndPlacement("update", oldObj) {
+		return nil
+	}
+	oldInfo := generatePodInfo("delete", oldObj)
+	if oldInfo == nil {
+		return nil
+	}
+
+	var newInfo *api.PodInfo
+	if filterForAnnotationAndPlacement("update", newObj) {
+		newInfo = generatePodInfo("update", newObj)
+	}
+	if newInfo == nil || newInfo.IPv4.String() != oldInfo.IPv4.String() {
+		return oldInfo
+	}
+
+	var removed []api.NATDefinition
+	for _, o := range oldInfo.Annotation.TableEntries {
+		if !slices.ContainsFunc(newInfo.Annotation.TableEntries, func(n api.NATDefinition) bool { return equalEntry(o, n) }) {
+			removed = append(removed, o)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	oldInfo.Annotation = &api.PodNATAnnotation{TableEntries: removed}
+
+	return oldInfo
+}
+
+// let the API server filter pods for this node (and opted-in pods), so
+// the informer cache does not hold all pods of the cluster
+func podListOptions(options *metav1.ListOptions) {
+	if common.NodeName != "" {
+		options.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", common.NodeName).String()
+	}
+	if common.PodLabelSelector != "" {
+		options.LabelSelector = common.PodLabelSelector
+	}
+}
+
+func NewPodInformer(clientSet kubernetes.Interface, subscriber []string, events *EventQueue) (*PodInformer, error) {
+	if _, err := labels.Parse(common.PodLabelSelector); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid pod label selector: %v", err))
+	}
+
+	return newPodInformer(clientSet, subscriber, events), nil
+}
+
+func newPodInformer(clientSet kubernetes.Interface, subscriber []string, events *EventQueue) *PodInformer {
 	in := &PodInformer{
-		factory: kubeinformers.NewSharedInformerFactory(clientSet, time.Duration(common.InformerResync)*time.Second),
+		factory: kubeinformers.NewSharedInformerFactoryWithOptions(
+			clientSet,
+			time.Duration(common.InformerResync)*time.Second,
+			kubeinformers.WithTweakListOptions(podListOptions),
+		),
 	}
-	_, _ = in.factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+	_, _ = in.factory.Core().V1().Pods().Informer().AddEventHandler(newPodEventHandler(subscriber, events))
+
+	return in
+}
+
+func newPodEventHandler(subscriber []string, events *EventQueue) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			if slices.Contains(subscriber, "add") && filterForAnnotationAndPlacement("add", obj) {
 				pod := generatePodInfo("add", obj)
 				if pod != nil {
 					klog.V(9).Infof("new pod added, matched filters: %s \n", pod.Name)
-					events <- pod
+					events.Add(pod)
 				}
 			}
 		},
@@ -117,20 +204,25 @@ func NewPodInformer(subscriber []string, events chan<- *api.PodInfo) *PodInforme
 				pod := generatePodInfo("delete", obj)
 				if pod != nil {
 					klog.V(9).Infof("pod deleted, matched filters: %s \n", pod.Name)
-					events <- pod
+					events.Add(pod)
 				}
 			}
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
+			if slices.Contains(subscriber, "delete") {
+				pod := generateRemovalInfo(oldObj, newObj)
+				if pod != nil {
+					klog.V(9).Infof("pod updated, removing %d NAT entries: %s \n", len(pod.Annotation.TableEntries), pod.Name)
+					events.Add(pod)
+				}
+			}
 			if slices.Contains(subscriber, "update") && filterForAnnotationAndPlacement("update", newObj) {
 				pod := generatePodInfo("update", newObj)
 				if pod != nil {
 					klog.V(9).Infof("pod updated, matched filters: %s \n", pod.Name)
-					events <- pod
+					events.Add(pod)
 				}
 			}
 		},
-	})
-
-	return in
+	}
 }
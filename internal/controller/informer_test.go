@@ -0,0 +1,267 @@
+package controller
+
+import (
+	"context"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+const testAnnotation = `{"entries":[{"srcPort":25,"dstPort":25}]}`
+
+func init() {
+	common.AnnotationKey = "bln.space/podnat"
+	common.NodeID = "node1"
+	common.InformerResync = 180
+}
+
+func newTestPod(name, node, ip string, annotation *string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			NodeName: node,
+		},
+		Status: corev1.PodStatus{
+			PodIP: ip,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+			},
+		},
+	}
+	if annotation != nil {
+		pod.ObjectMeta.Annotations = map[string]string{common.AnnotationKey: *annotation}
+	}
+	return pod
+}
+
+// collect drains all events currently queued or arriving within timeout
+func collect(t *testing.T, q *EventQueue, want int) []*api.PodInfo {
+	t.Helper()
+	var infos []*api.PodInfo
+	handler := func(info *api.PodInfo) error {
+		infos = append(infos, info)
+		return nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(infos) < want && time.Now().Before(deadline) {
+		if q.queue.Len() == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		q.processNextItem(handler)
+	}
+	if len(infos) != want {
+		t.Fatalf(`received %d events, want %d: %v`, len(infos), want, infos)
+	}
+	return infos
+}
+
+func startTestInformer(t *testing.T, client *fake.Clientset) *EventQueue {
+	t.Helper()
+	events := NewEventQueue()
+	in := newPodInformer(client, []string{"add", "update", "delete"}, events)
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		events.ShutDown()
+	})
+	in.factory.Start(stop)
+	in.factory.WaitForCacheSync(stop)
+	return events
+}
+
+func TestPodInformerAddUpdateDelete(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	events := startTestInformer(t, client)
+	pods := client.CoreV1().Pods("default")
+
+	pod := newTestPod("mail", "node1", "10.0.0.1", common.Ptr(testAnnotation))
+	if _, err := pods.Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	infos := collect(t, events, 1)
+	if infos[0].Event != "add" || infos[0].Name != "mail" || infos[0].IPv4.String() != "10.0.0.1" {
+		t.Fatalf(`unexpected add event %+v`, infos[0])
+	}
+
+	pod.ObjectMeta.Labels = map[string]string{"touched": "true"}
+	if _, err := pods.Update(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	infos = collect(t, events, 1)
+	if infos[0].Event != "update" {
+		t.Fatalf(`unexpected update event %+v`, infos[0])
+	}
+
+	if err := pods.Delete(context.TODO(), "mail", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	infos = collect(t, events, 1)
+	if infos[0].Event != "delete" || len(infos[0].Annotation.TableEntries) != 1 {
+		t.Fatalf(`unexpected delete event %+v`, infos[0])
+	}
+}
+
+func TestPodInformerIgnoresForeignPods(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	events := startTestInformer(t, client)
+	pods := client.CoreV1().Pods("default")
+
+	for _, pod := range []*corev1.Pod{
+		newTestPod("other-node", "node2", "10.0.0.2", common.Ptr(testAnnotation)),
+		newTestPod("no-annotation", "node1", "10.0.0.3", nil),
+		newTestPod("no-ip", "node1", "", common.Ptr(testAnnotation)),
+		newTestPod("matching", "node1.example.com", "10.0.0.4", common.Ptr(testAnnotation)),
+	} {
+		if _, err := pods.Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	infos := collect(t, events, 1)
+	if infos[0].Name != "matching" {
+		t.Fatalf(`unexpected event for pod %s`, infos[0].Name)
+	}
+}
+
+func TestPodEventHandlerTombstone(t *testing.T) {
+	events := NewEventQueue()
+	defer events.ShutDown()
+	handler := newPodEventHandler([]string{"delete"}, events)
+
+	pod := newTestPod("mail", "node1", "10.0.0.1", common.Ptr(testAnnotation))
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "default/mail", Obj: pod})
+	// tombstones of unknown objects must not panic
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "default/other", Obj: "garbage"})
+
+	infos := collect(t, events, 1)
+	if infos[0].Event != "delete" || infos[0].Name != "mail" || infos[0].IPv4.String() != "10.0.0.1" {
+		t.Fatalf(`unexpected tombstone delete event %+v`, infos[0])
+	}
+}
+
+func TestPodEventHandlerRemovedEntries(t *testing.T) {
+	events := NewEventQueue()
+	defer events.ShutDown()
+	handler := newPodEventHandler([]string{"update", "delete"}, events)
+
+	oldPod := newTestPod("mail", "node1", "10.0.0.1", common.Ptr(`{"entries":[{"srcPort":25,"dstPort":25},{"srcPort":143,"dstPort":143}]}`))
+	newPod := oldPod.DeepCopy()
+	newPod.ObjectMeta.Annotations[common.AnnotationKey] = `{"entries":[{"srcPort":25,"dstPort":25}]}`
+	handler.OnUpdate(oldPod, newPod)
+
+	infos := collect(t, events, 2)
+	if infos[0].Event != "delete" || len(infos[0].Annotation.TableEntries) != 1 || infos[0].Annotation.TableEntries[0].SourcePort != 143 {
+		t.Fatalf(`unexpected removal event %+v`, infos[0])
+	}
+	if infos[1].Event != "update" || len(infos[1].Annotation.TableEntries) != 1 || infos[1].Annotation.TableEntries[0].SourcePort != 25 {
+		t.Fatalf(`unexpected update event %+v`, infos[1])
+	}
+}
+
+func TestPodEventHandlerRemovedAnnotationAndReadiness(t *testing.T) {
+	events := NewEventQueue()
+	defer events.ShutDown()
+	handler := newPodEventHandler([]string{"update", "delete"}, events)
+
+	oldPod := newTestPod("mail", "node1", "10.0.0.1", common.Ptr(testAnnotation))
+	noAnnotation := oldPod.DeepCopy()
+	noAnnotation.ObjectMeta.Annotations = nil
+	handler.OnUpdate(oldPod, noAnnotation)
+
+	infos := collect(t, events, 1)
+	if infos[0].Event != "delete" || len(infos[0].Annotation.TableEntries) != 1 {
+		t.Fatalf(`unexpected removal event for removed annotation %+v`, infos[0])
+	}
+
+	unready := oldPod.DeepCopy()
+	unready.Status.Conditions[0].Status = corev1.ConditionFalse
+	handler.OnUpdate(oldPod, unready)
+
+	infos = collect(t, events, 1)
+	if infos[0].Event != "delete" || len(infos[0].Annotation.TableEntries) != 1 {
+		t.Fatalf(`unexpected removal event for unready pod %+v`, infos[0])
+	}
+
+	// unchanged pods only refresh their rules
+	handler.OnUpdate(oldPod, oldPod.DeepCopy())
+	infos = collect(t, events, 1)
+	if infos[0].Event != "update" {
+		t.Fatalf(`unexpected event for unchanged pod %+v`, infos[0])
+	}
+}
+
+func TestPodListOptions(t *testing.T) {
+	defer func() {
+		common.NodeName = ""
+		common.PodLabelSelector = ""
+	}()
+
+	options := metav1.ListOptions{}
+	podListOptions(&options)
+	if options.FieldSelector != "" || options.LabelSelector != "" {
+		t.Fatalf(`expected cluster wide list options, got %+v`, options)
+	}
+
+	common.NodeName = "node1.example.com"
+	common.PodLabelSelector = "bln.space/podnat=enabled"
+	podListOptions(&options)
+	if options.FieldSelector != "spec.nodeName=node1.example.com" {
+		t.Fatalf(`field selector = %q, want %q`, options.FieldSelector, "spec.nodeName=node1.example.com")
+	}
+	if options.LabelSelector != "bln.space/podnat=enabled" {
+		t.Fatalf(`label selector = %q, want %q`, options.LabelSelector, "bln.space/podnat=enabled")
+	}
+}
+
+// the informer and the state share one clientset like in the controller
+func TestPodInformerWithSharedClientState(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	events := NewEventQueue()
+	defer events.ShutDown()
+	in, err := NewPodInformer(client, []string{"add", "update", "delete"}, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go in.Run(ctx)
+	store := state.NewConfigMapState(client)
+
+	pod := newTestPod("mail", "node1", "10.0.0.1", common.Ptr(testAnnotation))
+	if _, err := client.CoreV1().Pods("default").Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info := collect(t, events, 1)[0]
+	s := state.NewState()
+	s.Rules[info.IPv4.String()] = []*api.NATRule{{DestinationIP: info.IPv4, Comment: info.Name}}
+	if err := store.Save(s); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules := loaded.Rules["10.0.0.1"]; len(rules) != 1 || rules[0].Comment != "mail" {
+		t.Fatalf(`state after pod event = %v`, loaded.Rules)
+	}
+}
+
+func TestNewPodInformerInvalidSelector(t *testing.T) {
+	common.PodLabelSelector = "a in (b"
+	defer func() { common.PodLabelSelector = "" }()
+	if _, err := NewPodInformer(fake.NewSimpleClientset(), []string{"add"}, NewEventQueue()); err == nil {
+		t.Fatalf(`NewPodInformer() with invalid label selector succeeded`)
+	}
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	maxEventRetries = 10
+	retryBaseDelay  = time.Second
+	retryMaxDelay   = 2 * time.Minute
+	eventQueueName  = "podnat"
+)
+
+// EventQueue decouples informer callbacks from firewall processing. The
+// workqueue only holds pod keys (namespace/name) and therefore dedupes bursts
+// of events, the pending pod infos per key are kept in order next to it.
+type EventQueue struct {
+	queue   workqueue.RateLimitingInterface
+	pending map[string][]*api.PodInfo
+	mutex   sync.Mutex
+}
+
+func podKey(info *api.PodInfo) string {
+	return fmt.Sprintf("%s/%s", info.Namespace, info.Name)
+}
+
+// add and update events carry the full annotation, so only the latest one
+// is relevant, while deletions must always be processed
+func coalesce(infos []*api.PodInfo, info *api.PodInfo) []*api.PodInfo {
+	if n := len(infos); n > 0 && infos[n-1].Event != "delete" && info.Event != "delete" {
+		infos[n-1] = info
+		return infos
+	}
+	return append(infos, info)
+}
+
+func (q *EventQueue) Add(info *api.PodInfo) {
+	key := podKey(info)
+	q.mutex.Lock()
+	q.pending[key] = coalesce(q.pending[key], info)
+	q.mutex.Unlock()
+	q.queue.Add(key)
+}
+
+func (q *EventQueue) pop(key string) []*api.PodInfo {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	infos := q.pending[key]
+	delete(q.pending, key)
+	return infos
+}
+
+// put failed infos back in front of everything received in the meantime
+func (q *EventQueue) requeue(key string, failed []*api.PodInfo) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	infos := failed
+	for _, info := range q.pending[key] {
+		infos = coalesce(infos, info)
+	}
+	q.pending[key] = infos
+}
+
+func (q *EventQueue) processNextItem(handler func(*api.PodInfo) error) bool {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+
+	key := item.(string)
+	infos := q.pop(key)
+	for i, info := range infos {
+		err := handler(info)
+		if err == nil {
+			continue
+		}
+		if q.queue.NumRequeues(key) < maxEventRetries {
+			klog.Warningf("processing %s event for pod %s failed, retrying: %v\n", info.Event, key, err)
+			q.requeue(key, infos[i:])
+			q.queue.AddRateLimited(key)
+			return true
+		}
+		klog.Errorf("processing %s event for pod %s failed %d times, dropping: %v\n", info.Event, key, maxEventRetries, err)
+		q.queue.Forget(key)
+	}
+	q.queue.Forget(key)
+
+	return true
+}
+
+// Run processes queued events with handler until the queue is shut down.
+func (q *EventQueue) Run(handler func(*api.PodInfo) error) {
+	for q.processNextItem(handler) {
+	}
+}
+
+func (q *EventQueue) ShutDown() {
+	q.queue.ShutDown()
+}
+
+// Drain stops accepting events, Run returns as soon as the queued events
+// are processed. Retries of failed events are dropped.
+func (q *EventQueue) Drain() {
+	q.queue.ShutDownWithDrain()
+}
+
+func NewEventQueue() *EventQueue {
+	return &EventQueue{
+		queue: workqueue.NewNamedRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(retryBaseDelay, retryMaxDelay),
+			eventQueueName,
+		),
+		pending: make(map[string][]*api.PodInfo),
+	}
+}
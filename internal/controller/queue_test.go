@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"errors"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"reflect"
+	"testing"
+)
+
+func TestEventQueueCoalescesUpdates(t *testing.T) {
+	q := NewEventQueue()
+	defer q.ShutDown()
+
+	q.Add(&api.PodInfo{Event: "add", Name: "mail", Namespace: "default"})
+	q.Add(&api.PodInfo{Event: "update", Name: "mail", Namespace: "default"})
+	q.Add(&api.PodInfo{Event: "update", Name: "mail", Namespace: "default"})
+	q.Add(&api.PodInfo{Event: "delete", Name: "mail", Namespace: "default"})
+	q.Add(&api.PodInfo{Event: "update", Name: "web", Namespace: "default"})
+
+	var processed []string
+	handler := func(info *api.PodInfo) error {
+		processed = append(processed, info.Event+":"+info.Name)
+		return nil
+	}
+	for q.queue.Len() > 0 {
+		q.processNextItem(handler)
+	}
+
+	expected := []string{"update:mail", "delete:mail", "update:web"}
+	if !reflect.DeepEqual(processed, expected) {
+		t.Fatalf(`processed events = %v, want %v`, processed, expected)
+	}
+}
+
+func TestEventQueueRetriesFailedEvents(t *testing.T) {
+	q := NewEventQueue()
+	defer q.ShutDown()
+
+	q.Add(&api.PodInfo{Event: "add", Name: "mail", Namespace: "default"})
+
+	calls := 0
+	handler := func(info *api.PodInfo) error {
+		calls++
+		if calls == 1 {
+			return errors.New("iptables lock held")
+		}
+		return nil
+	}
+
+	q.processNextItem(handler)
+	if q.queue.NumRequeues("default/mail") != 1 {
+		t.Fatalf(`requeues = %d, want 1`, q.queue.NumRequeues("default/mail"))
+	}
+
+	// blocks until the rate limited retry is due
+	q.processNextItem(handler)
+	if calls != 2 {
+		t.Fatalf(`handler calls = %d, want 2`, calls)
+	}
+	if q.queue.NumRequeues("default/mail") != 0 {
+		t.Fatalf(`requeues after success = %d, want 0`, q.queue.NumRequeues("default/mail"))
+	}
+}
+
+func TestEventQueueDrainProcessesQueuedEvents(t *testing.T) {
+	q := NewEventQueue()
+
+	q.Add(&api.PodInfo{Event: "add", Name: "mail", Namespace: "default"})
+	q.Add(&api.PodInfo{Event: "add", Name: "web", Namespace: "default"})
+
+	drained := make(chan struct{})
+	go func() {
+		q.Drain()
+		close(drained)
+	}()
+
+	var processed []string
+	q.Run(func(info *api.PodInfo) error {
+		processed = append(processed, info.Name)
+		return nil
+	})
+	<-drained
+
+	// events added after the shutdown are ignored
+	q.Add(&api.PodInfo{Event: "add", Name: "late", Namespace: "default"})
+	if !reflect.DeepEqual(processed, []string{"mail", "web"}) {
+		t.Fatalf(`processed events = %v, want [mail web]`, processed)
+	}
+}
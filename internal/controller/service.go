@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ServiceInformer watches annotated services and their endpoint slices. For
+// every service one ready endpoint on this node is selected as NAT target,
+// if it becomes unready another local endpoint takes over.
+type ServiceInformer struct {
+	factory  kubeinformers.SharedInformerFactory
+	services corelisters.ServiceLister
+	slices   discoverylisters.EndpointSliceLister
+	events   *EventQueue
+	selected map[string]*api.PodInfo
+	mutex    sync.Mutex
+}
+
+type serviceEndpoint struct {
+	name string
+	ip   string
+}
+
+// Run starts the informer and blocks until ctx is cancelled and all
+// informer goroutines are stopped.
+func (i *ServiceInformer) Run(ctx context.Context) {
+	defer runtime.HandleCrash()
+	i.factory.Start(ctx.Done())
+	<-ctx.Done()
+	i.factory.Shutdown()
+}
+
+// localEndpoints returns the ready IPv4 endpoints of a service on this node,
+// sorted by name to keep the selection stable across nodes and restarts
+func (i *ServiceInformer) localEndpoints(namespace, name string) ([]serviceEndpoint, error) {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: name})
+	endpointSlices, err := i.slices.EndpointSlices(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []serviceEndpoint
+	for _, slice := range endpointSlices {
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.NodeName == nil || common.ShortHostName(*ep.NodeName) != common.NodeID {
+				continue
+			}
+			// unset ready condition has to be interpreted as ready
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			if len(ep.Addresses) == 0 || common.ParseIP(ep.Addresses[0]) == nil {
+				continue
+			}
+			endpoint := serviceEndpoint{name: ep.Addresses[0], ip: ep.Addresses[0]}
+			if ep.TargetRef != nil {
+				endpoint.name = ep.TargetRef.Name
+			}
+			result = append(result, endpoint)
+		}
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].name < result[b].name })
+
+	return result, nil
+}
+
+func (i *ServiceInformer) generateServiceInfo(event string, service *corev1.Service, endpoint serviceEndpoint) *api.PodInfo {
+	annotation, err := api.ParseAnnotation(service.ObjectMeta.Annotations[common.AnnotationKey])
+	if err != nil {
+		klog.Warningf("ignoring service %s with invalid annotation, error: '%v'\n", service.Name, err)
+		return nil
+	}
+
+	return &api.PodInfo{
+		Event:      event,
+		Name:       fmt.Sprintf("service/%s", service.Name),
+		Namespace:  service.Namespace,
+		Node:       common.NodeID,
+		Annotation: annotation,
+		IPv4:       common.ParseIP(endpoint.ip),
+	}
+}
+
+func (i *ServiceInformer) sync(namespace, name string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	key := fmt.Sprintf("%s/%s", namespace, name)
+	previous := i.selected[key]
+
+	var next *api.PodInfo
+	service, err := i.services.Services(namespace).Get(name)
+	switch {
+	case k8serr.IsNotFound(err):
+	case err != nil:
+		klog.Warningf("could not get service %s: %v\n", key, err)
+		return
+	default:
+		if _, ok := service.ObjectMeta.Annotations[common.AnnotationKey]; !ok {
+			break
+		}
+		endpoints, err := i.localEndpoints(namespace, name)
+		if err != nil {
+			klog.Warningf("could not list endpoints for service %s: %v\n", key, err)
+			return
+		}
+		if len(endpoints) == 0 {
+			break
+		}
+		// keep the current endpoint as long as it is ready
+		endpoint := endpoints[0]
+		for _, e := range endpoints {
+			if previous != nil && e.ip == previous.IPv4.String() {
+				endpoint = e
+				break
+			}
+		}
+		next = i.generateServiceInfo("update", service, endpoint)
+	}
+
+	if previous != nil {
+		removal := *previous
+		removal.Event = "delete"
+		if next != nil && next.IPv4.String() == previous.IPv4.String() {
+			var removed []api.NATDefinition
+			for _, o := range previous.Annotation.TableEntries {
+				if !slices.ContainsFunc(next.Annotation.TableEntries, func(n api.NATDefinition) bool { return equalEntry(o, n) }) {
+					removed = append(removed, o)
+				}
+			}
+			removal.Annotation = &api.PodNATAnnotation{TableEntries: removed}
+		} else {
+			klog.Infof("service %s endpoint %s no longer selected\n", key, previous.IPv4)
+		}
+		if len(removal.Annotation.TableEntries) > 0 {
+			i.events.Add(&removal)
+		}
+	}
+
+	if next == nil {
+		delete(i.selected, key)
+		return
+	}
+	if previous == nil || next.IPv4.String() != previous.IPv4.String() {
+		klog.Infof("service %s selected local endpoint %s\n", key, next.IPv4)
+		next.Event = "add"
+	}
+	i.selected[key] = next
+	i.events.Add(next)
+}
+
+func (i *ServiceInformer) handleService(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Warningf("ignoring service object: %v\n", err)
+		return
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	i.sync(namespace, name)
+}
+
+// watched returns true for annotated services and services with a selected
+// endpoint, slices of other services are ignored
+func (i *ServiceInformer) watched(namespace, name string) bool {
+	i.mutex.Lock()
+	_, selected := i.selected[fmt.Sprintf("%s/%s", namespace, name)]
+	i.mutex.Unlock()
+	if selected {
+		return true
+	}
+	service, err := i.services.Services(namespace).Get(name)
+	if err != nil {
+		return false
+	}
+	_, ok := service.ObjectMeta.Annotations[common.AnnotationKey]
+	return ok
+}
+
+func (i *ServiceInformer) handleEndpointSlice(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		klog.Warningf("ignoring unexpected object type %T\n", obj)
+		return
+	}
+	name, ok := slice.Labels[discoveryv1.LabelServiceName]
+	if !ok || !i.watched(slice.Namespace, name) {
+		return
+	}
+	i.sync(slice.Namespace, name)
+}
+
+// endpoint slices inherit the labels of their service, so the selector
+// scopes both caches
+func serviceListOptions(options *metav1.ListOptions) {
+	options.LabelSelector = common.ServiceLabelSelector
+}
+
+func NewServiceInformer(clientSet kubernetes.Interface, events *EventQueue) (*ServiceInformer, error) {
+	if _, err := labels.Parse(common.ServiceLabelSelector); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid service label selector: %v", err))
+	}
+
+	factory := kubeinformers.NewSharedInformerFactoryWithOptions(
+		clientSet,
+		time.Duration(common.InformerResync)*time.Second,
+		kubeinformers.WithTweakListOptions(serviceListOptions),
+	)
+	in := &ServiceInformer{
+		factory:  factory,
+		services: factory.Core().V1().Services().Lister(),
+		slices:   factory.Discovery().V1().EndpointSlices().Lister(),
+		events:   events,
+		selected: make(map[string]*api.PodInfo),
+	}
+	_, _ = factory.Core().V1().Services().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    in.handleService,
+		UpdateFunc: func(oldObj, newObj interface{}) { in.handleService(newObj) },
+		DeleteFunc: in.handleService,
+	})
+	_, _ = factory.Discovery().V1().EndpointSlices().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    in.handleEndpointSlice,
+		UpdateFunc: func(oldObj, newObj interface{}) { in.handleEndpointSlice(newObj) },
+		DeleteFunc: in.handleEndpointSlice,
+	})
+
+	return in, nil
+}
@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestEndpoint(pod, node, ip string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{ip},
+		Conditions: discoveryv1.EndpointConditions{Ready: common.Ptr(ready)},
+		NodeName:   common.Ptr(node),
+		TargetRef:  &corev1.ObjectReference{Kind: "Pod", Name: pod, Namespace: "default"},
+	}
+}
+
+func newTestEndpointSlice(endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "ingress-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "ingress"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+	}
+}
+
+func startTestServiceInformer(t *testing.T, client *fake.Clientset) *EventQueue {
+	t.Helper()
+	events := NewEventQueue()
+	in, err := NewServiceInformer(client, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		events.ShutDown()
+	})
+	in.factory.Start(stop)
+	in.factory.WaitForCacheSync(stop)
+	return events
+}
+
+func TestServiceInformerFailover(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	events := startTestServiceInformer(t, client)
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "ingress",
+			Namespace:   "default",
+			Annotations: map[string]string{common.AnnotationKey: testAnnotation},
+		},
+	}
+	if _, err := client.CoreV1().Services("default").Create(context.TODO(), service, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	slice := newTestEndpointSlice(
+		newTestEndpoint("ingress-a", "node1", "10.0.0.1", true),
+		newTestEndpoint("ingress-b", "node1", "10.0.0.2", true),
+		newTestEndpoint("ingress-c", "node2", "10.0.1.1", true),
+	)
+	slices := client.DiscoveryV1().EndpointSlices("default")
+	if _, err := slices.Create(context.TODO(), slice, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the service and slice handlers fire in any order, each of them syncs
+	// the selection, so the endpoint might be refreshed more than once
+	infos := collectUntil(t, events, "selection of 10.0.0.1", selected("10.0.0.1"))
+	for _, info := range infos {
+		if info.Event == "delete" || info.Name != "service/ingress" || info.IPv4.String() != "10.0.0.1" {
+			t.Fatalf(`unexpected add event %+v`, info)
+		}
+	}
+
+	slice.Endpoints[0].Conditions.Ready = common.Ptr(false)
+	if _, err := slices.Update(context.TODO(), slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	infos = withoutRefreshes(collectUntil(t, events, "failover to 10.0.0.2", selected("10.0.0.2")), "10.0.0.1")
+	if len(infos) < 2 || infos[0].Event != "delete" || infos[0].IPv4.String() != "10.0.0.1" {
+		t.Fatalf(`unexpected removal events %v`, infos)
+	}
+	for _, info := range infos[1:] {
+		if info.Event == "delete" || info.IPv4.String() != "10.0.0.2" {
+			t.Fatalf(`unexpected failover event %+v`, info)
+		}
+	}
+
+	if err := client.CoreV1().Services("default").Delete(context.TODO(), "ingress", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	infos = withoutRefreshes(collectUntil(t, events, "removal of 10.0.0.2", removed("10.0.0.2")), "10.0.0.2")
+	if len(infos) != 1 {
+		t.Fatalf(`unexpected delete events %v`, infos)
+	}
+}
+
+// collectUntil processes events until done returns true for the events
+// received so far
+func collectUntil(t *testing.T, q *EventQueue, what string, done func([]*api.PodInfo) bool) []*api.PodInfo {
+	t.Helper()
+	var infos []*api.PodInfo
+	handler := func(info *api.PodInfo) error {
+		infos = append(infos, info)
+		return nil
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !done(infos) {
+		if time.Now().After(deadline) {
+			t.Fatalf(`timeout waiting for %s, received %v`, what, infos)
+		}
+		if q.queue.Len() == 0 {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		q.processNextItem(handler)
+	}
+	return infos
+}
+
+func selected(ip string) func([]*api.PodInfo) bool {
+	return func(infos []*api.PodInfo) bool {
+		return len(infos) > 0 && infos[len(infos)-1].Event != "delete" && infos[len(infos)-1].IPv4.String() == ip
+	}
+}
+
+func removed(ip string) func([]*api.PodInfo) bool {
+	return func(infos []*api.PodInfo) bool {
+		return len(infos) > 0 && infos[len(infos)-1].Event == "delete" && infos[len(infos)-1].IPv4.String() == ip
+	}
+}
+
+// withoutRefreshes drops the refreshes of the endpoint ip, which late
+// handlers of the previous step might still add
+func withoutRefreshes(infos []*api.PodInfo, ip string) []*api.PodInfo {
+	var filtered []*api.PodInfo
+	for _, info := range infos {
+		if info.Event != "delete" && info.IPv4.String() == ip {
+			continue
+		}
+		filtered = append(filtered, info)
+	}
+	return filtered
+}
+
+func TestServiceInformerWatched(t *testing.T) {
+	in, err := NewServiceInformer(fake.NewSimpleClientset(), NewEventQueue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := in.factory.Core().V1().Services().Informer().GetStore()
+	_ = store.Add(&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}})
+	_ = store.Add(&corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name: "ingress", Namespace: "default", Annotations: map[string]string{common.AnnotationKey: testAnnotation},
+	}})
+
+	if in.watched("default", "web") || in.watched("default", "missing") {
+		t.Fatal(`slices of services without annotation are watched`)
+	}
+	if !in.watched("default", "ingress") {
+		t.Fatal(`slices of annotated service are not watched`)
+	}
+	// the endpoint of a service without annotation has to be removed
+	in.selected["default/web"] = &api.PodInfo{}
+	if !in.watched("default", "web") {
+		t.Fatal(`slices of service with selected endpoint are not watched`)
+	}
+
+	common.ServiceLabelSelector = "podnat in (true"
+	defer func() { common.ServiceLabelSelector = "" }()
+	if _, err := NewServiceInformer(fake.NewSimpleClientset(), NewEventQueue()); err == nil {
+		t.Fatal(`NewServiceInformer() with invalid selector succeeded`)
+	}
+}
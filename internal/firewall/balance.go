@@ -0,0 +1,241 @@
+package firewall
+
+import (
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// IPTablesBalancer distributes new connections for one public ip:port over
+// several pods. The PREROUTING chain only holds a jump into a dedicated chain
+// per mapping, which is rebuilt whenever the set of backends changes.
+type IPTablesBalancer struct {
+	Chain    string
+	Jump     []string
+	Rules    [][]string
+	Backends []*api.NATRule
+}
+
+func balancerChainName(key string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return strings.ToUpper(fmt.Sprintf("%s_LB_%08x", common.ResourcePrefix, h.Sum32()))
+}
+
+func balancerChainPrefix() string {
+	return strings.ToUpper(fmt.Sprintf("%s_LB_", common.ResourcePrefix))
+}
+
+func latestRule(rules []*api.NATRule) *api.NATRule {
+	var latest *api.NATRule
+	for _, rule := range rules {
+		if latest == nil || rule.Created.After(latest.Created) {
+			latest = rule
+		}
+	}
+	return latest
+}
+
+// the latest created rule decides, if the mapping is balanced at all
+func isBalanced(rules []*api.NATRule) bool {
+	latest := latestRule(rules)
+	return latest != nil && latest.Balance != ""
+}
+
+// rules from older states have no weight
+func weightOf(rule *api.NATRule) uint32 {
+	if rule.Weight == 0 {
+		return 1
+	}
+	return uint32(rule.Weight)
+}
+
+func dnatTarget(rule *api.NATRule) []string {
+	return []string{
+		"-m", "comment", "--comment", rule.Comment, "-j", "DNAT",
+		"--to-destination", fmt.Sprintf("%s:%d", rule.DestinationIP, rule.DestinationPort),
+	}
+}
+
+// probability formats p like iptables -S after the kernel rounded it to
+// 1/2^31 steps, so the rules can be compared with the live chains
+func probability(p float64) string {
+	return fmt.Sprintf("%.11f", math.Round(p*0x80000000)/0x80000000)
+}
+
+func recentName(chain string, rule *api.NATRule) string {
+	return fmt.Sprintf("%s_%s_%d", chain, rule.DestinationIP, rule.DestinationPort)
+}
+
+func newIPTablesBalancer(key string, rules []*api.NATRule) *IPTablesBalancer {
+	backends := make([]*api.NATRule, len(rules))
+	copy(backends, rules)
+	sort.Slice(backends, func(a, b int) bool {
+		return backends[a].DestinationIP.String() < backends[b].DestinationIP.String()
+	})
+
+	latest := latestRule(backends)
+	mode := latest.Balance
+	sticky := latest.Sticky
+
+	first := backends[0]
+	b := &IPTablesBalancer{
+		Chain:    balancerChainName(key),
+		Backends: backends,
+	}
+	b.Jump = []string{
+		"-d", fmt.Sprintf("%s/32", first.SourceIP.String()), "-p", first.Protocol, "-m", first.Protocol,
+		"--dport", fmt.Sprint(first.SourcePort), "-m", "comment", "--comment", key, "-j", b.Chain,
+	}
+
+	// returning clients are sent to the same backend as long as they are
+	// seen within the sticky interval, --update refreshes the last seen time
+	if sticky > 0 {
+		for _, rule := range backends {
+			spec := []string{
+				"-m", "recent", "--update", "--seconds", fmt.Sprint(sticky), "--reap",
+				"--name", recentName(b.Chain, rule), "--mask", "255.255.255.255", "--rsource",
+			}
+			b.Rules = append(b.Rules, append(spec, dnatTarget(rule)...))
+		}
+	}
+
+	// nth mode applies weights by repeating the backend in the slot list
+	var slots []*api.NATRule
+	var remainingWeight uint32
+	for _, rule := range backends {
+		repeat := uint32(1)
+		if mode == "nth" {
+			repeat = weightOf(rule)
+		}
+		for i := uint32(0); i < repeat; i++ {
+			slots = append(slots, rule)
+		}
+		remainingWeight += weightOf(rule)
+	}
+
+	for i, rule := range slots {
+		var spec []string
+		switch {
+		// last rule catches all remaining connections
+		case i == len(slots)-1:
+		case mode == "nth":
+			spec = []string{"-m", "statistic", "--mode", "nth", "--every", fmt.Sprint(len(slots) - i), "--packet", "0"}
+		default:
+			spec = []string{
+				"-m", "statistic", "--mode", "random", "--probability",
+				probability(float64(weightOf(rule)) / float64(remainingWeight)),
+			}
+			remainingWeight -= weightOf(rule)
+		}
+		if sticky > 0 {
+			spec = append(spec, "-m", "recent", "--set", "--name", recentName(b.Chain, rule), "--mask", "255.255.255.255", "--rsource")
+		}
+		b.Rules = append(b.Rules, append(spec, dnatTarget(rule)...))
+	}
+
+	return b
+}
+
+func (b *IPTablesBalancer) signature() string {
+	var parts []string
+	parts = append(parts, strings.Join(b.Jump, " "))
+	for _, rule := range b.Rules {
+		parts = append(parts, strings.Join(rule, " "))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// reconcileBalancers brings the balancer chains in line with the desired
+// state, unchanged balancers are not touched to keep conntrack and counters
+func (p *IPTablesProcessor) reconcileBalancers(desired map[string]*IPTablesBalancer, preChain IPTablesChain) error {
+	if common.DryRun {
+		for _, b := range desired {
+			klog.Warningf("dry-run activated, not applying balancer chain %s: %v\n", b.Chain, b.Rules)
+		}
+		return nil
+	}
+
+	// pick up chains of a previous run, their content is unknown
+	if p.balancers == nil {
+		p.balancers = make(map[string]string)
+		chains, err := p.ipt.ListChains(preChain.Table)
+		if err != nil {
+			return err
+		}
+		for _, chain := range chains {
+			if strings.HasPrefix(chain, balancerChainPrefix()) {
+				p.balancers[chain] = ""
+			}
+		}
+	}
+
+	for _, b := range desired {
+		sig := b.signature()
+		if current, ok := p.balancers[b.Chain]; ok && current == sig {
+			continue
+		}
+		klog.Infof("[chain:%s] updating balancer for %d backends\n", b.Chain, len(b.Backends))
+		if err := p.ensureChain(IPTablesChain{Name: b.Chain, Table: preChain.Table}); err != nil {
+			return err
+		}
+		if err := p.ipt.ClearChain(preChain.Table, b.Chain); err != nil {
+			return err
+		}
+		for _, rule := range b.Rules {
+			if err := p.ipt.Append(preChain.Table, b.Chain, rule...); err != nil {
+				return err
+			}
+		}
+		if err := p.ipt.AppendUnique(preChain.Table, preChain.Name, b.Jump...); err != nil {
+			return err
+		}
+		// single backend DNAT rules would shadow the jump into the balancer
+		for _, rule := range b.Backends {
+			if err := p.ipt.DeleteIfExists(preChain.Table, preChain.Name, p.getRule(preChain, rule)...); err != nil {
+				klog.Warningf("failed deleting single backend rule %v: %v\n", rule, err)
+			}
+		}
+		p.balancers[b.Chain] = sig
+	}
+
+	var obsolete []string
+	for chain := range p.balancers {
+		if _, ok := desired[chain]; !ok {
+			obsolete = append(obsolete, chain)
+		}
+	}
+	if len(obsolete) == 0 {
+		return nil
+	}
+
+	rules, err := p.ipt.List(preChain.Table, preChain.Name)
+	if err != nil {
+		return err
+	}
+	// delete jumps by rule number from the end, the first list entry is the chain itself
+	for i := len(rules) - 1; i > 0; i-- {
+		for _, chain := range obsolete {
+			if strings.HasSuffix(rules[i], fmt.Sprintf("-j %s", chain)) {
+				klog.Infof("[chain:%s] deleting jump to obsolete balancer %s\n", preChain.Name, chain)
+				if err := p.ipt.Delete(preChain.Table, preChain.Name, fmt.Sprint(i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, chain := range obsolete {
+		if err := p.ipt.ClearAndDeleteChain(preChain.Table, chain); err != nil {
+			return err
+		}
+		delete(p.balancers, chain)
+	}
+
+	return nil
+}
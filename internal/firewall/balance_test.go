@@ -0,0 +1,92 @@
+package firewall
+
+import (
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newBalancedRules(mode string, sticky uint32, weights ...uint16) []*api.NATRule {
+	var rules []*api.NATRule
+	for i, weight := range weights {
+		rules = append(rules, &api.NATRule{
+			Protocol:        "udp",
+			SourceIP:        common.ParseIP("1.2.3.4"),
+			SourcePort:      27015,
+			DestinationIP:   common.ParseIP(fmt.Sprintf("10.0.0.%d", i+1)),
+			DestinationPort: 27015,
+			Created:         time.Now().Add(time.Duration(i) * time.Second),
+			Comment:         "games:server",
+			Balance:         mode,
+			Weight:          weight,
+			Sticky:          sticky,
+		})
+	}
+	return rules
+}
+
+func TestBalancerRandomWeights(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	b := newIPTablesBalancer("1.2.3.4:27015", newBalancedRules("random", 0, 1, 2, 1))
+
+	if !strings.HasPrefix(b.Chain, "PODNAT_LB_") || len(b.Chain) > 28 {
+		t.Fatalf(`invalid balancer chain name %s`, b.Chain)
+	}
+
+	var got []string
+	for _, rule := range b.Rules {
+		got = append(got, strings.Join(rule, " "))
+	}
+	expected := []string{
+		"-m statistic --mode random --probability 0.25000000000 -m comment --comment games:server -j DNAT --to-destination 10.0.0.1:27015",
+		"-m statistic --mode random --probability 0.66666666651 -m comment --comment games:server -j DNAT --to-destination 10.0.0.2:27015",
+		"-m comment --comment games:server -j DNAT --to-destination 10.0.0.3:27015",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("balancer rules =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestBalancerNthSticky(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	b := newIPTablesBalancer("1.2.3.4:27015", newBalancedRules("nth", 60, 2, 1))
+
+	// two sticky checks and three slots for the weighted round robin
+	if len(b.Rules) != 5 {
+		t.Fatalf(`balancer rule count = %d, want 5`, len(b.Rules))
+	}
+	// --update refreshes the last seen time, so stickiness ends after the
+	// client was idle for the interval
+	check := strings.Join(b.Rules[0], " ")
+	expected := fmt.Sprintf(
+		"-m recent --update --seconds 60 --reap --name %s_10.0.0.1_27015 --mask 255.255.255.255 --rsource -m comment --comment games:server -j DNAT --to-destination 10.0.0.1:27015",
+		b.Chain,
+	)
+	if check != expected {
+		t.Fatalf("sticky check rule =\n%s\nwant\n%s", check, expected)
+	}
+	for i, every := range []string{"--every 3", "--every 2", ""} {
+		rule := strings.Join(b.Rules[i+2], " ")
+		if every != "" && !strings.Contains(rule, every) {
+			t.Fatalf(`rule %s does not contain %s`, rule, every)
+		}
+		if !strings.Contains(rule, "--set") {
+			t.Fatalf(`rule %s does not record sticky source`, rule)
+		}
+	}
+}
+
+func TestIsBalancedFollowsLatestRule(t *testing.T) {
+	rules := newBalancedRules("random", 0, 1, 1)
+	if !isBalanced(rules) {
+		t.Fatal(`expected balanced mapping`)
+	}
+	rules[1].Balance = ""
+	if isBalanced(rules) {
+		t.Fatal(`latest rule without balance mode must disable balancing`)
+	}
+}
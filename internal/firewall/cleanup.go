@@ -0,0 +1,78 @@
+package firewall
+
+import (
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// Cleanup removes the jump rules, the podnat chains and the balancer chains
+// of the resource prefix. Errors are logged and cleanup continues, the last
+// error is returned.
+func (p *IPTablesProcessor) Cleanup() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var lastErr error
+	for _, chain := range p.chains {
+		rules, err := p.ipt.List(chain.Table, chain.ParentChain)
+		if err != nil {
+			klog.Warningf("listing chain %s in table %s failed: %v\n", chain.ParentChain, chain.Table, err)
+			lastErr = err
+			continue
+		}
+		// delete jumps by rule number from the end, the first list entry is the chain itself
+		for i := len(rules) - 1; i > 0; i-- {
+			if !strings.HasSuffix(rules[i], fmt.Sprintf("-j %s", chain.Name)) {
+				continue
+			}
+			klog.Infof("[chain:%s] deleting jump rule %s\n", chain.ParentChain, rules[i])
+			if common.DryRun {
+				continue
+			}
+			if err := p.ipt.Delete(chain.Table, chain.ParentChain, fmt.Sprint(i)); err != nil {
+				klog.Warningf("deleting jump rule %s failed: %v\n", rules[i], err)
+				lastErr = err
+			}
+		}
+	}
+
+	// the prerouting chain references the balancer chains, delete it first
+	var chains []IPTablesChain
+	for _, chain := range p.chains {
+		chains = append(chains, chain)
+		if chain.ParentChain != "PREROUTING" {
+			continue
+		}
+		existing, err := p.ipt.ListChains(chain.Table)
+		if err != nil {
+			klog.Warningf("listing chains of table %s failed: %v\n", chain.Table, err)
+			lastErr = err
+			continue
+		}
+		for _, name := range existing {
+			if strings.HasPrefix(name, balancerChainPrefix()) {
+				chains = append(chains, IPTablesChain{Name: name, Table: chain.Table})
+			}
+		}
+	}
+	for _, chain := range chains {
+		exists, err := p.ipt.ChainExists(chain.Table, chain.Name)
+		if err != nil || !exists {
+			continue
+		}
+		klog.Infof("deleting chain %s in table %s\n", chain.Name, chain.Table)
+		if common.DryRun {
+			continue
+		}
+		if err := p.ipt.ClearAndDeleteChain(chain.Table, chain.Name); err != nil {
+			klog.Warningf("deleting chain %s in table %s failed: %v\n", chain.Name, chain.Table, err)
+			lastErr = err
+		}
+	}
+	p.balancers = nil
+
+	return lastErr
+}
@@ -0,0 +1,62 @@
+package firewall
+
+import (
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"reflect"
+	"testing"
+)
+
+type cleanupMock struct {
+	listMock
+	deleted *[]string
+}
+
+func (i cleanupMock) Delete(table string, chain string, rulespec ...string) error {
+	*i.deleted = append(*i.deleted, chain+" "+rulespec[0])
+	return nil
+}
+func (i cleanupMock) ClearAndDeleteChain(table string, chain string) error {
+	*i.deleted = append(*i.deleted, chain)
+	return nil
+}
+
+func TestCleanup(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "-2,-2,-2"
+	common.DryRun = false
+	proc := NewIpTablesRenderer(nil)
+	var deleted []string
+	proc.ipt = cleanupMock{
+		listMock: listMock{chains: map[string][]string{
+			"FORWARD": {
+				"-A FORWARD -m comment --comment \"podnat[jump_to_chain]\" -j PODNAT_FORWARD",
+				"-A FORWARD -j ACCEPT",
+			},
+			"PREROUTING": {
+				"-A PREROUTING -j CILIUM_PRE_nat",
+				"-A PREROUTING -m comment --comment \"podnat[jump_to_chain]\" -j PODNAT_PRE",
+				"-A PREROUTING -m comment --comment \"podnat[jump_to_chain]\" -j PODNAT_PRE",
+			},
+			"PODNAT_FORWARD":     {},
+			"PODNAT_PRE":         {},
+			"PODNAT_LB_00000001": {},
+		}},
+		deleted: &deleted,
+	}
+
+	if err := proc.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	// rule numbers count from 1, duplicates are deleted from the end
+	expected := []string{
+		"FORWARD 1",
+		"PREROUTING 3",
+		"PREROUTING 2",
+		"PODNAT_FORWARD",
+		"PODNAT_PRE",
+		"PODNAT_LB_00000001",
+	}
+	if !reflect.DeepEqual(deleted, expected) {
+		t.Fatalf(`deleted = %v, want %v`, deleted, expected)
+	}
+}
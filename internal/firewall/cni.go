@@ -0,0 +1,123 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// cniPlugin describes the jumps a CNI plugin keeps in the parent chains,
+// the podnat jump is placed next to them instead of at a fixed position
+type cniPlugin struct {
+	Name   string
+	Prefix string
+	Jumps  map[string]string
+}
+
+var cniPlugins = []cniPlugin{
+	{
+		Name:   "cilium",
+		Prefix: "CILIUM_",
+		Jumps: map[string]string{
+			"FORWARD":     "CILIUM_FORWARD",
+			"PREROUTING":  "CILIUM_PRE_nat",
+			"POSTROUTING": "CILIUM_POST_nat",
+		},
+	},
+	{
+		Name:   "calico",
+		Prefix: "cali-",
+		Jumps: map[string]string{
+			"FORWARD":     "cali-FORWARD",
+			"PREROUTING":  "cali-PREROUTING",
+			"POSTROUTING": "cali-POSTROUTING",
+		},
+	},
+}
+
+// detectCNI returns the plugin owning chains in the filter or nat table
+func detectCNI(ipt IPTablesInterface) (*cniPlugin, error) {
+	for _, table := range []string{"filter", "nat"} {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return nil, err
+		}
+		for i := range cniPlugins {
+			for _, chain := range chains {
+				if strings.HasPrefix(chain, cniPlugins[i].Prefix) {
+					return &cniPlugins[i], nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// setupCNI selects the CNI plugin of the integration mode
+func (p *IPTablesProcessor) setupCNI() error {
+	p.cni = nil
+	switch common.CNIIntegration {
+	case "", "none":
+		return nil
+	case "auto":
+		plugin, err := detectCNI(p.ipt)
+		if err != nil {
+			return errors.New(fmt.Sprintf("detecting CNI plugin failed: %v", err))
+		}
+		if plugin == nil {
+			klog.Infof("no CNI plugin chains found, using numeric jump positions\n")
+			return nil
+		}
+		p.cni = plugin
+	default:
+		for i := range cniPlugins {
+			if cniPlugins[i].Name == common.CNIIntegration {
+				p.cni = &cniPlugins[i]
+			}
+		}
+	}
+	klog.Infof("CNI integration %s, placing jumps %s the CNI jumps\n", p.cni.Name, common.CNIJumpPlacement)
+	return nil
+}
+
+// cniRulePosition returns the position next to the CNI jump in the parent
+// chain. The position is computed without the podnat jump (jump), so it is
+// valid for inserting after deleting a misplaced jump and equals the
+// current position of a jump at the right place.
+func (p *IPTablesProcessor) cniRulePosition(chain IPTablesChain, rules []string, jump string) (int, bool) {
+	if p.cni == nil {
+		return 0, false
+	}
+	target, ok := p.cni.Jumps[chain.ParentChain]
+	if !ok {
+		return 0, false
+	}
+	pos := 0
+	for _, rule := range rules {
+		if rule == jump {
+			continue
+		}
+		if strings.HasSuffix(rule, " -j "+target) {
+			if common.CNIJumpPlacement == "after" {
+				return pos + 1, true
+			}
+			return pos, true
+		}
+		pos++
+	}
+	klog.V(2).Infof("[chain:%s] no jump to %s found, using numeric position\n", chain.ParentChain, target)
+	return 0, false
+}
+
+// jumpRefreshDuration is short with CNI integration, the plugins rewrite
+// their chains (e.g. on agent restarts) and the jump must follow quickly
+func (p *IPTablesProcessor) jumpRefreshDuration() time.Duration {
+	if p.cni != nil {
+		return time.Duration(common.CNIRefresh) * time.Second
+	}
+	return p.jumpChainRefreshDuration
+}
@@ -0,0 +1,243 @@
+package firewall
+
+import (
+	"bufio"
+	"errors"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// saveMock serves chains parsed from iptables-save output and applies
+// inserts and deletes to them
+type saveMock struct {
+	IPTablesMock
+	tables  map[string]map[string][]string
+	order   map[string][]string
+	changes *int
+}
+
+func loadSaveMock(t *testing.T, fixture string) saveMock {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	m := saveMock{tables: make(map[string]map[string][]string), order: make(map[string][]string), changes: new(int)}
+	var table string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+			m.tables[table] = make(map[string][]string)
+		case strings.HasPrefix(line, ":"):
+			chain := strings.Fields(line[1:])[0]
+			m.tables[table][chain] = nil
+			m.order[table] = append(m.order[table], chain)
+		case strings.HasPrefix(line, "-A "):
+			chain := strings.Fields(line)[1]
+			m.tables[table][chain] = append(m.tables[table][chain], line)
+		}
+	}
+	return m
+}
+
+// rule formats a rulespec like iptables -S
+func (m saveMock) rule(chain string, rulespec []string) string {
+	return ruleLine(chain, rulespec)
+}
+
+func (m saveMock) List(table string, chain string) ([]string, error) {
+	return append([]string{"-P " + chain + " ACCEPT"}, m.tables[table][chain]...), nil
+}
+func (m saveMock) ListChains(table string) ([]string, error) { return m.order[table], nil }
+func (m saveMock) Insert(table string, chain string, pos int, rulespec ...string) error {
+	*m.changes++
+	rules := m.tables[table][chain]
+	if pos > len(rules)+1 {
+		return errors.New("index of insertion too big")
+	}
+	m.tables[table][chain] = append(rules[:pos-1], append([]string{m.rule(chain, rulespec)}, rules[pos-1:]...)...)
+	return nil
+}
+func (m saveMock) Delete(table string, chain string, rulespec ...string) error {
+	*m.changes++
+	rules := m.tables[table][chain]
+	for i, rule := range rules {
+		if rule == m.rule(chain, rulespec) {
+			m.tables[table][chain] = append(rules[:i:i], rules[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("bad rule (does a matching rule exist in that chain?)")
+}
+func (m saveMock) DeleteIfExists(table string, chain string, rulespec ...string) error {
+	if exists, _ := m.Exists(table, chain, rulespec...); !exists {
+		return nil
+	}
+	return m.Delete(table, chain, rulespec...)
+}
+func (m saveMock) Append(table string, chain string, rulespec ...string) error {
+	*m.changes++
+	m.tables[table][chain] = append(m.tables[table][chain], m.rule(chain, rulespec))
+	return nil
+}
+func (m saveMock) AppendUnique(table string, chain string, rulespec ...string) error {
+	if exists, _ := m.Exists(table, chain, rulespec...); exists {
+		return nil
+	}
+	return m.Append(table, chain, rulespec...)
+}
+func (m saveMock) ClearChain(table string, chain string) error {
+	if _, ok := m.tables[table][chain]; !ok {
+		return m.NewChain(table, chain)
+	}
+	*m.changes++
+	m.tables[table][chain] = nil
+	return nil
+}
+func (m saveMock) ChainExists(table string, chain string) (bool, error) {
+	_, ok := m.tables[table][chain]
+	return ok, nil
+}
+func (m saveMock) NewChain(table string, chain string) error {
+	*m.changes++
+	m.tables[table][chain] = nil
+	m.order[table] = append(m.order[table], chain)
+	return nil
+}
+func (m saveMock) Exists(table string, chain string, rulespec ...string) (bool, error) {
+	for _, rule := range m.tables[table][chain] {
+		if rule == m.rule(chain, rulespec) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// neighbour returns the target of the rule before (offset -1) or after the
+// podnat jump in the parent chain
+func (m saveMock) neighbour(chain IPTablesChain, offset int) string {
+	rules := m.tables[chain.Table][chain.ParentChain]
+	for i, rule := range rules {
+		if !strings.HasSuffix(rule, "-j "+chain.Name) {
+			continue
+		}
+		if i+offset < 0 || i+offset >= len(rules) {
+			return ""
+		}
+		fields := strings.Fields(rules[i+offset])
+		return fields[len(fields)-1]
+	}
+	return ""
+}
+
+func TestDetectCNI(t *testing.T) {
+	for fixture, expected := range map[string]string{
+		"cilium.iptables-save":     "cilium",
+		"calico.iptables-save":     "calico",
+		"kube-proxy.iptables-save": "",
+	} {
+		plugin, err := detectCNI(loadSaveMock(t, fixture))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := ""
+		if plugin != nil {
+			name = plugin.Name
+		}
+		if name != expected {
+			t.Errorf(`detectCNI(%s) = %q, want %q`, fixture, name, expected)
+		}
+	}
+}
+
+func TestCNIJumpPlacement(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "-2,-2,-2"
+	common.CNIIntegration = "auto"
+	defer func() { common.CNIIntegration = "none" }()
+
+	for _, fixture := range []string{"cilium.iptables-save", "calico.iptables-save"} {
+		for _, placement := range []string{"before", "after"} {
+			common.CNIJumpPlacement = placement
+			offset := 1
+			if placement == "after" {
+				offset = -1
+			}
+			m := loadSaveMock(t, fixture)
+			proc := NewIpTablesRenderer(nil)
+			proc.ipt = m
+			if err := proc.setupCNI(); err != nil || proc.cni == nil {
+				t.Fatalf(`%s: setupCNI() = %v, plugin %v`, fixture, err, proc.cni)
+			}
+
+			for _, chain := range proc.chains {
+				if err := proc.ensureJumpToChain(chain); err != nil {
+					t.Fatal(err)
+				}
+				if n := m.neighbour(chain, offset); n != proc.cni.Jumps[chain.ParentChain] {
+					t.Fatalf(`%s: jump %s %s %s, want %s`, fixture, placement, chain.ParentChain, n, proc.cni.Jumps[chain.ParentChain])
+				}
+			}
+
+			// the CNI moves its jump to the end, e.g. after an agent restart
+			chain := proc.chains[0]
+			rules := m.tables[chain.Table][chain.ParentChain]
+			for i, rule := range rules {
+				if strings.HasSuffix(rule, "-j "+proc.cni.Jumps[chain.ParentChain]) {
+					m.tables[chain.Table][chain.ParentChain] = append(append(rules[:i:i], rules[i+1:]...), rule)
+					break
+				}
+			}
+			if err := proc.ensureJumpToChain(chain); err != nil {
+				t.Fatal(err)
+			}
+			if n := m.neighbour(chain, offset); n != proc.cni.Jumps[chain.ParentChain] {
+				t.Fatalf(`%s: jump %s %s %s after CNI change, want %s`, fixture, placement, chain.ParentChain, n, proc.cni.Jumps[chain.ParentChain])
+			}
+
+			// jumps at the right place are not touched
+			*m.changes = 0
+			for _, chain := range proc.chains {
+				if err := proc.ensureJumpToChain(chain); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if *m.changes != 0 {
+				t.Fatalf(`%s: %d changes for jumps %s the CNI jumps, want none`, fixture, *m.changes, placement)
+			}
+		}
+	}
+}
+
+func TestCNIFallbackToNumericPosition(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "1,1,1"
+	common.CNIIntegration = "auto"
+	defer func() { common.CNIIntegration = "none" }()
+
+	m := loadSaveMock(t, "kube-proxy.iptables-save")
+	proc := NewIpTablesRenderer(nil)
+	proc.ipt = m
+	if err := proc.setupCNI(); err != nil || proc.cni != nil {
+		t.Fatalf(`setupCNI() = %v, plugin %v, want none`, err, proc.cni)
+	}
+	for _, chain := range proc.chains {
+		if err := proc.ensureJumpToChain(chain); err != nil {
+			t.Fatal(err)
+		}
+		if first := m.tables[chain.Table][chain.ParentChain][0]; !strings.HasSuffix(first, "-j "+chain.Name) {
+			t.Fatalf(`first rule of %s = %s, want podnat jump`, chain.ParentChain, first)
+		}
+	}
+	if refresh := proc.jumpRefreshDuration(); refresh != proc.jumpChainRefreshDuration {
+		t.Fatalf(`jump refresh without CNI = %v, want %v`, refresh, proc.jumpChainRefreshDuration)
+	}
+}
@@ -0,0 +1,133 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// NewIpTablesInspector returns a processor with the rules of remoteState
+// for comparing them with the live chains or cleaning up, the chains are
+// not set up.
+func NewIpTablesInspector(remoteState state.StateStore) (*IPTablesProcessor, error) {
+	ipt, err := iptables.New()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("initializing of iptables failed: %v", err))
+	}
+	proc := &IPTablesProcessor{
+		ipt:   ipt,
+		state: remoteState,
+	}
+	proc.fetchState()
+	proc.configure()
+	return proc, nil
+}
+
+// saveQuote quotes like xtables_save_string of iptables -S, only args made
+// of letters, digits, '_' and '-' are printed as is
+func saveQuote(s string) string {
+	plain := s != ""
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		if c == '"' || c == '\\' || c == '\'' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// ruleLine formats a rulespec like iptables -S prints it, only comments are
+// quoted by iptables, the other args of the rendered rules are canonical
+func ruleLine(chain string, rulespec []string) string {
+	args := []string{"-A", chain}
+	for i, arg := range rulespec {
+		if i > 0 && rulespec[i-1] == "--comment" {
+			arg = saveQuote(arg)
+		}
+		args = append(args, arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// Diff compares the rules expected from the state with the live chains.
+// Add lists rules missing in the kernel, Delete rules not backed by the
+// state and Keep rules present in both.
+func (p *IPTablesProcessor) Diff() (*Plan, error) {
+	plan := newPlan()
+	chains := p.renderChains()
+
+	// balancer chains of mappings no longer in the state
+	known := make(map[string]bool)
+	for _, chain := range chains {
+		known[chain.Name] = true
+	}
+	for _, chain := range p.chains {
+		if chain.ParentChain != "PREROUTING" {
+			continue
+		}
+		names, err := p.ipt.ListChains(chain.Table)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, balancerChainPrefix()) && !known[name] {
+				chains = append(chains, renderedChain{Table: chain.Table, Name: name})
+			}
+		}
+	}
+
+	for _, chain := range chains {
+		c := plan.chain(chain.Table, chain.Name)
+
+		var live []string
+		exists, err := p.ipt.ChainExists(chain.Table, chain.Name)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			lines, err := p.ipt.List(chain.Table, chain.Name)
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range lines {
+				if strings.HasPrefix(line, "-A ") {
+					live = append(live, line)
+				}
+			}
+		}
+
+		expected := make(map[string]bool)
+		for _, rule := range chain.Rules {
+			line := ruleLine(chain.Name, rule)
+			expected[line] = true
+			if slices.Contains(live, line) {
+				c.Keep = append(c.Keep, rule)
+				continue
+			}
+			c.Add = append(c.Add, rule)
+		}
+		for _, line := range live {
+			if !expected[line] {
+				c.Delete = append(c.Delete, strings.Fields(strings.TrimPrefix(line, fmt.Sprintf("-A %s ", chain.Name))))
+			}
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,89 @@
+package firewall
+
+import (
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listMock returns fixed iptables -S output per chain
+type listMock struct {
+	IPTablesMock
+	chains map[string][]string
+}
+
+func (i listMock) List(table string, chain string) ([]string, error) {
+	return append([]string{"-N " + chain}, i.chains[chain]...), nil
+}
+func (i listMock) ChainExists(table string, chain string) (bool, error) {
+	_, ok := i.chains[chain]
+	return ok, nil
+}
+func (i listMock) ListChains(table string) ([]string, error) {
+	var chains []string
+	for chain := range i.chains {
+		chains = append(chains, chain)
+	}
+	return chains, nil
+}
+
+func TestDiff(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "-2,-2,-2"
+	proc := NewIpTablesRenderer(nil)
+	proc.internalNetworks = nil
+	proc.rules = map[string][]*api.NATRule{
+		"1.2.3.4:25": {{
+			Protocol: "tcp", SourceIP: common.ParseIP("1.2.3.4"), SourcePort: 25,
+			DestinationIP: common.ParseIP("10.0.0.5"), DestinationPort: 25, Created: time.Now(), Comment: "mail:mail",
+		}},
+		"1.2.3.4:27015": newBalancedRules("random", 60, 1, 1),
+	}
+	// iptables -S output of a node, comments are quoted by iptables and
+	// statistic and recent matches are printed with all their defaults
+	proc.ipt = listMock{chains: map[string][]string{
+		"PODNAT_FORWARD": {
+			`-A PODNAT_FORWARD -d 10.0.0.5/32 -p tcp -m conntrack --ctstate NEW -m tcp --dport 25 -m comment --comment "mail:mail" -j ACCEPT`,
+			`-A PODNAT_FORWARD -d 10.0.0.1/32 -p udp -m conntrack --ctstate NEW -m udp --dport 27015 -m comment --comment "games:server" -j ACCEPT`,
+			`-A PODNAT_FORWARD -d 10.0.0.2/32 -p udp -m conntrack --ctstate NEW -m udp --dport 27015 -m comment --comment "games:server" -j ACCEPT`,
+		},
+		"PODNAT_PRE": {
+			`-A PODNAT_PRE -d 1.2.3.4/32 -p tcp -m tcp --dport 25 -m comment --comment "mail:old" -j DNAT --to-destination 10.0.0.9:25`,
+			`-A PODNAT_PRE -d 1.2.3.4/32 -p udp -m udp --dport 27015 -m comment --comment "1.2.3.4:27015" -j PODNAT_LB_370C9B2C`,
+		},
+		"PODNAT_LB_370C9B2C": {
+			`-A PODNAT_LB_370C9B2C -m recent --update --seconds 60 --reap --name PODNAT_LB_370C9B2C_10.0.0.1_27015 --mask 255.255.255.255 --rsource -m comment --comment "games:server" -j DNAT --to-destination 10.0.0.1:27015`,
+			`-A PODNAT_LB_370C9B2C -m recent --update --seconds 60 --reap --name PODNAT_LB_370C9B2C_10.0.0.2_27015 --mask 255.255.255.255 --rsource -m comment --comment "games:server" -j DNAT --to-destination 10.0.0.2:27015`,
+			`-A PODNAT_LB_370C9B2C -m statistic --mode random --probability 0.50000000000 -m recent --set --name PODNAT_LB_370C9B2C_10.0.0.1_27015 --mask 255.255.255.255 --rsource -m comment --comment "games:server" -j DNAT --to-destination 10.0.0.1:27015`,
+			`-A PODNAT_LB_370C9B2C -m recent --set --name PODNAT_LB_370C9B2C_10.0.0.2_27015 --mask 255.255.255.255 --rsource -m comment --comment "games:server" -j DNAT --to-destination 10.0.0.2:27015`,
+		},
+		"PODNAT_LB_00000001": {
+			`-A PODNAT_LB_00000001 -j DNAT --to-destination 10.0.0.7:27015`,
+		},
+	}}
+
+	plan, err := proc.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chain := range []string{"PODNAT_FORWARD", "PODNAT_LB_370C9B2C"} {
+		c := plan.Chains[chain]
+		if len(c.Keep) != len(proc.ipt.(listMock).chains[chain]) || len(c.Add) != 0 || len(c.Delete) != 0 {
+			t.Fatalf(`rules of %s not detected as present: %v`, chain, c)
+		}
+	}
+	pre := plan.Chains["PODNAT_PRE"]
+	if len(pre.Keep) != 1 || len(pre.Add) != 1 || len(pre.Delete) != 1 || !strings.Contains(strings.Join(pre.Delete[0], " "), "mail:old") {
+		t.Fatalf(`unexpected diff for prerouting chain: %v`, pre)
+	}
+	if len(plan.Chains["PODNAT_POST"].Add) != 3 {
+		t.Fatalf(`missing postrouting chain not detected: %v`, plan.Chains["PODNAT_POST"])
+	}
+	expected := [][]string{{"-j", "DNAT", "--to-destination", "10.0.0.7:27015"}}
+	if !reflect.DeepEqual(plan.Chains["PODNAT_LB_00000001"].Delete, expected) {
+		t.Fatalf(`orphaned balancer chain not detected: %v`, plan.Chains["PODNAT_LB_00000001"])
+	}
+}
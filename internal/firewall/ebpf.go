@@ -0,0 +1,380 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// natKey mirrors struct podnat_key of the tc programs in build/bpf, address
+// and port are kept in network byte order like in the packet
+type natKey struct {
+	Addr  [4]byte
+	Port  uint16
+	Proto uint8
+}
+
+// natValue mirrors struct podnat_value of the tc programs
+type natValue struct {
+	Addr [4]byte
+	Port uint16
+}
+
+// natEntry is the raw key or value of a map entry, both are 8 bytes
+type natEntry [8]byte
+
+func (k natKey) entry() natEntry {
+	var e natEntry
+	copy(e[0:4], k.Addr[:])
+	binary.BigEndian.PutUint16(e[4:6], k.Port)
+	e[6] = k.Proto
+	return e
+}
+
+func (v natValue) entry() natEntry {
+	var e natEntry
+	copy(e[0:4], v.Addr[:])
+	binary.BigEndian.PutUint16(e[4:6], v.Port)
+	return e
+}
+
+func (e natEntry) String() string {
+	return fmt.Sprintf("%s:%d/%d", net.IP(e[0:4]), binary.BigEndian.Uint16(e[4:6]), e[6])
+}
+
+func natProto(proto string) (uint8, error) {
+	switch proto {
+	case "tcp":
+		return protoTCP, nil
+	case "udp":
+		return protoUDP, nil
+	}
+	return 0, errors.New(fmt.Sprintf("protocol %s not supported by the ebpf backend", proto))
+}
+
+// bpfMap is the subset of a BPF hash map used by the processor, the kernel
+// maps are only available on linux, the in-memory map makes the processor
+// usable in tests and dry-run without loading programs
+type bpfMap interface {
+	Update(key, value natEntry) error
+	Delete(key natEntry) error
+	Entries() (map[natEntry]natEntry, error)
+}
+
+type memMap struct {
+	entries map[natEntry]natEntry
+}
+
+func newMemMap() *memMap {
+	return &memMap{entries: make(map[natEntry]natEntry)}
+}
+
+func (m *memMap) Update(key, value natEntry) error {
+	m.entries[key] = value
+	return nil
+}
+
+func (m *memMap) Delete(key natEntry) error {
+	if _, ok := m.entries[key]; !ok {
+		return errors.New(fmt.Sprintf("map entry %s does not exist", key))
+	}
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *memMap) Entries() (map[natEntry]natEntry, error) {
+	entries := make(map[natEntry]natEntry, len(m.entries))
+	for k, v := range m.entries {
+		entries[k] = v
+	}
+	return entries, nil
+}
+
+// EBPFProcessor rewrites packets of NAT mappings with tc programs instead
+// of iptables DNAT and conntrack. The ingress program looks up public
+// ip:port in the dnat map, the egress program the pod ip:port of replies
+// in the snat map.
+type EBPFProcessor struct {
+	dnat                  bpfMap
+	snat                  bpfMap
+	detach                func() error
+	state                 state.StateStore
+	stored                *state.State
+	base                  map[string]bool
+	rules                 map[string][]*api.NATRule
+	publicNodeIP          *net.IPAddr
+	ruleStalenessDuration time.Duration
+	ruleExpiryDuration    time.Duration
+	mutex                 sync.Mutex
+	stop                  chan struct{}
+	stopOnce              sync.Once
+}
+
+func newEBPFProcessor(remoteState state.StateStore, dnat, snat bpfMap) *EBPFProcessor {
+	return &EBPFProcessor{
+		dnat:                  dnat,
+		snat:                  snat,
+		state:                 remoteState,
+		stored:                state.NewState(),
+		rules:                 make(map[string][]*api.NATRule),
+		ruleStalenessDuration: time.Duration(common.RuleStaleness) * time.Second,
+		ruleExpiryDuration:    time.Duration(common.RuleExpiryInterval) * time.Second,
+		stop:                  make(chan struct{}),
+	}
+}
+
+func (p *EBPFProcessor) Apply(event *api.PodInfo) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	mergeEvent(p.rules, event, p.publicNodeIP, p.ruleStalenessDuration)
+
+	if err := p.reconcileMaps(); err != nil {
+		klog.Errorf("reconciling ebpf maps failed with error: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+func (p *EBPFProcessor) isStale(rule *api.NATRule) bool {
+	return time.Since(rule.LastVerified) >= p.ruleStalenessDuration
+}
+
+// dropStaleRules removes stale rules and rules replaced by a newer pod like
+// the iptables backend, balanced mappings keep all backends in the state
+func (p *EBPFProcessor) dropStaleRules() {
+	for k, ruleList := range p.rules {
+		latest := latestRule(ruleList)
+		balanced := isBalanced(ruleList)
+		var active []*api.NATRule
+		for _, rule := range ruleList {
+			if !p.isStale(rule) && (balanced || !rule.Created.Before(latest.Created)) {
+				active = append(active, rule)
+			}
+		}
+		if len(active) == 0 {
+			klog.Infof("empty NAT mapping, removing: %s\n", k)
+			delete(p.rules, k)
+			continue
+		}
+		p.rules[k] = active
+	}
+}
+
+// desiredEntries returns the map entries of the rules. A map entry has a
+// single backend, so balanced mappings of a previous iptables run use the
+// latest pod. Replies are looked up by pod ip:port only, if mappings share
+// it the latest created one wins and the others are skipped.
+func (p *EBPFProcessor) desiredEntries() (map[natEntry]natEntry, map[natEntry]natEntry) {
+	var keys []string
+	for k, ruleList := range p.rules {
+		if latestRule(ruleList) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := latestRule(p.rules[keys[i]]), latestRule(p.rules[keys[j]])
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		return keys[i] < keys[j]
+	})
+
+	dnat := make(map[natEntry]natEntry)
+	snat := make(map[natEntry]natEntry)
+	for _, k := range keys {
+		rule := latestRule(p.rules[k])
+		proto, err := natProto(rule.Protocol)
+		if err != nil || rule.SourceIP == nil || rule.DestinationIP == nil {
+			klog.Warningf("skipping rule not supported by the ebpf backend: %v\n", rule)
+			continue
+		}
+		source, destination := rule.SourceIP.IP.To4(), rule.DestinationIP.IP.To4()
+		if source == nil || destination == nil {
+			klog.Warningf("skipping rule not supported by the ebpf backend: %v\n", rule)
+			continue
+		}
+		public := natKey{Port: rule.SourcePort, Proto: proto}
+		copy(public.Addr[:], source)
+		pod := natKey{Port: rule.DestinationPort, Proto: proto}
+		copy(pod.Addr[:], destination)
+		if _, ok := snat[pod.entry()]; ok {
+			klog.Warningf("skipping rule %s, replies of %s are already mapped by another rule: %v\n", k, pod.entry(), rule)
+			continue
+		}
+		dnat[public.entry()] = natValue{Addr: pod.Addr, Port: pod.Port}.entry()
+		snat[pod.entry()] = natValue{Addr: public.Addr, Port: public.Port}.entry()
+	}
+	return dnat, snat
+}
+
+// syncMap updates changed entries and deletes entries without rule, entries
+// of a previous run are picked up from the pinned map
+func syncMap(name string, m bpfMap, desired map[natEntry]natEntry) error {
+	current, err := m.Entries()
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed listing %s map: %v", name, err))
+	}
+	for key, value := range desired {
+		if existing, ok := current[key]; ok && existing == value {
+			continue
+		}
+		klog.Infof("[map:%s] updating %s => %s\n", name, key, value)
+		if common.DryRun {
+			klog.Warningf("dry-run activated, not updating map entry %s\n", key)
+			continue
+		}
+		if err := m.Update(key, value); err != nil {
+			return errors.New(fmt.Sprintf("failed updating %s map entry %s: %v", name, key, err))
+		}
+	}
+	for key := range current {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		klog.Infof("[map:%s] deleting %s\n", name, key)
+		if common.DryRun {
+			klog.Warningf("dry-run activated, not deleting map entry %s\n", key)
+			continue
+		}
+		if err := m.Delete(key); err != nil {
+			klog.Warningf("failed deleting %s map entry %s: %v\n", name, key, err)
+		}
+	}
+	return nil
+}
+
+// reconcileMaps applies the rules and writes the state, rules deleted or
+// added by others are applied right away
+func (p *EBPFProcessor) reconcileMaps() error {
+	for round := 0; round < maxMergeRounds; round++ {
+		p.dropStaleRules()
+		dnat, snat := p.desiredEntries()
+		// replies are rewritten before new connections reach the pod
+		if err := syncMap("snat", p.snat, snat); err != nil {
+			return err
+		}
+		if err := syncMap("dnat", p.dnat, dnat); err != nil {
+			return err
+		}
+		if !p.syncState() {
+			return nil
+		}
+	}
+	return mergeRoundsExceeded()
+}
+
+// informer events only arrive on changes and resyncs, so expire
+// rules periodically to get rid of them even when no event is coming
+func (p *EBPFProcessor) expireRules() {
+	for {
+		p.mutex.Lock()
+		expiry := p.ruleExpiryDuration
+		p.mutex.Unlock()
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(expiry):
+		}
+		p.mutex.Lock()
+		if err := p.reconcileMaps(); err != nil {
+			klog.Warningf("expiring stale rules failed with error: %v\n", err)
+		}
+		p.mutex.Unlock()
+	}
+}
+
+func (p *EBPFProcessor) init() error {
+	p.fetchState()
+	p.publicNodeIP, _ = common.GetPublicIPAddress(4)
+	if err := p.reconcileMaps(); err != nil {
+		return err
+	}
+	go p.expireRules()
+	return nil
+}
+
+func (p *EBPFProcessor) fetchState() {
+	p.stored = loadState(p.state)
+	p.rules = p.stored.Rules
+	p.base = ruleIDs(p.rules)
+}
+
+// syncState writes the rules, returns true if changes of others were merged
+// and have to be reconciled
+func (p *EBPFProcessor) syncState() bool {
+	var merged bool
+	p.base, merged = saveState(p.state, p.stored, p.base, p.rules)
+	return merged
+}
+
+// WatchState applies changes of others to the state (e.g. by the state
+// subcommand) right away instead of on the next conflicting write, until
+// changes is closed.
+func (p *EBPFProcessor) WatchState(changes <-chan *state.State) {
+	for change := range changes {
+		p.mutex.Lock()
+		var merged bool
+		p.base, merged = mergeChange(p.stored, p.base, p.rules, change)
+		if merged {
+			if err := p.reconcileMaps(); err != nil {
+				klog.Warningf("applying state changes of others failed with error: %v\n", err)
+			}
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// Reconfigure applies changed settings of the config file, only rule
+// staleness and expiry are used by the ebpf backend.
+func (p *EBPFProcessor) Reconfigure(apply func() error) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := apply(); err != nil {
+		return err
+	}
+	p.ruleStalenessDuration = time.Duration(common.RuleStaleness) * time.Second
+	p.ruleExpiryDuration = time.Duration(common.RuleExpiryInterval) * time.Second
+	return nil
+}
+
+// Shutdown stops the expiry loop and writes the state a last time, the
+// programs and pinned maps stay in place, so traffic keeps flowing during
+// a restart.
+func (p *EBPFProcessor) Shutdown() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.syncState()
+}
+
+// Cleanup detaches the programs and removes all map entries.
+func (p *EBPFProcessor) Cleanup() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.detach != nil {
+		if err := p.detach(); err != nil {
+			return err
+		}
+	}
+	p.rules = make(map[string][]*api.NATRule)
+	if err := syncMap("snat", p.snat, nil); err != nil {
+		return err
+	}
+	return syncMap("dnat", p.dnat, nil)
+}
@@ -0,0 +1,387 @@
+//go:build linux
+
+package firewall
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"os"
+	"path/filepath"
+	"runtime"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// keep in sync with max_entries in build/bpf/podnat.c
+	ebpfMapEntries = 65536
+	// the filters share the priority with other tc programs on the
+	// interface (e.g. of the CNI), the handle keeps them apart
+	ebpfFilterPriority = 1
+	ebpfFilterHandle   = 0x504e
+	// BPF_LD | BPF_IMM | BPF_DW, the only instruction referencing maps
+	bpfLoadImm64 = 0x18
+)
+
+// attributes of the bpf syscall, see union bpf_attr in linux/bpf.h
+type bpfMapCreateAttr struct {
+	MapType    uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	MapFlags   uint32
+}
+
+type bpfMapElemAttr struct {
+	MapFd uint32
+	_     uint32
+	Key   uint64
+	Value uint64
+	Flags uint64
+}
+
+type bpfObjAttr struct {
+	Pathname  uint64
+	BpfFd     uint32
+	FileFlags uint32
+}
+
+type bpfProgLoadAttr struct {
+	ProgType    uint32
+	InsnCnt     uint32
+	Insns       uint64
+	License     uint64
+	LogLevel    uint32
+	LogSize     uint32
+	LogBuf      uint64
+	KernVersion uint32
+	ProgFlags   uint32
+	ProgName    [16]byte
+}
+
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func bpfPointer(p unsafe.Pointer) uint64 {
+	return uint64(uintptr(p))
+}
+
+// sysMap is a pinned BPF hash map with natEntry keys and values
+type sysMap struct {
+	fd int
+}
+
+func (m *sysMap) elem(cmd int, key, value *natEntry, flags uint64) error {
+	attr := bpfMapElemAttr{MapFd: uint32(m.fd), Key: bpfPointer(unsafe.Pointer(key)), Flags: flags}
+	if value != nil {
+		attr.Value = bpfPointer(unsafe.Pointer(value))
+	}
+	_, err := bpfCall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+func (m *sysMap) Update(key, value natEntry) error {
+	return m.elem(unix.BPF_MAP_UPDATE_ELEM, &key, &value, unix.BPF_ANY)
+}
+
+func (m *sysMap) Delete(key natEntry) error {
+	return m.elem(unix.BPF_MAP_DELETE_ELEM, &key, nil, 0)
+}
+
+func (m *sysMap) Entries() (map[natEntry]natEntry, error) {
+	entries := make(map[natEntry]natEntry)
+	var key, next natEntry
+	attr := bpfMapElemAttr{MapFd: uint32(m.fd), Value: bpfPointer(unsafe.Pointer(&next))}
+	for first := true; ; first = false {
+		// without key the first key of the map is returned
+		attr.Key = 0
+		if !first {
+			attr.Key = bpfPointer(unsafe.Pointer(&key))
+		}
+		_, err := bpfCall(unix.BPF_MAP_GET_NEXT_KEY, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if errors.Is(err, unix.ENOENT) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		key = next
+		var value natEntry
+		err = m.elem(unix.BPF_MAP_LOOKUP_ELEM, &key, &value, 0)
+		if errors.Is(err, unix.ENOENT) {
+			// deleted meanwhile
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries[key] = value
+	}
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&next)
+	return entries, nil
+}
+
+// openMap opens the map pinned at path or creates and pins it, entries of
+// a previous run stay in place
+func openMap(path string) (*sysMap, error) {
+	name := append([]byte(path), 0)
+	obj := bpfObjAttr{Pathname: bpfPointer(unsafe.Pointer(&name[0]))}
+	fd, err := bpfCall(unix.BPF_OBJ_GET, unsafe.Pointer(&obj), unsafe.Sizeof(obj))
+	runtime.KeepAlive(name)
+	if err == nil {
+		return &sysMap{fd: fd}, nil
+	}
+	if !errors.Is(err, unix.ENOENT) {
+		return nil, errors.New(fmt.Sprintf("opening pinned map %s failed: %v", path, err))
+	}
+
+	create := bpfMapCreateAttr{
+		MapType:    unix.BPF_MAP_TYPE_HASH,
+		KeySize:    uint32(len(natEntry{})),
+		ValueSize:  uint32(len(natEntry{})),
+		MaxEntries: ebpfMapEntries,
+	}
+	fd, err = bpfCall(unix.BPF_MAP_CREATE, unsafe.Pointer(&create), unsafe.Sizeof(create))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("creating map %s failed: %v", path, err))
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	obj.BpfFd = uint32(fd)
+	_, err = bpfCall(unix.BPF_OBJ_PIN, unsafe.Pointer(&obj), unsafe.Sizeof(obj))
+	runtime.KeepAlive(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, errors.New(fmt.Sprintf("pinning map %s failed: %v", path, err))
+	}
+	klog.Infof("created ebpf map %s\n", path)
+	return &sysMap{fd: fd}, nil
+}
+
+// loadProgram loads a tc program, the verifier log is only requested after
+// a failure, a too small log buffer fails the load otherwise
+func loadProgram(name string, insns []byte, license string) (int, error) {
+	if len(insns) == 0 || len(insns)%8 != 0 {
+		return 0, errors.New(fmt.Sprintf("program %s has no valid instructions", name))
+	}
+	lic := append([]byte(license), 0)
+	log := make([]byte, 1<<20)
+	attr := bpfProgLoadAttr{
+		ProgType: unix.BPF_PROG_TYPE_SCHED_CLS,
+		InsnCnt:  uint32(len(insns) / 8),
+		Insns:    bpfPointer(unsafe.Pointer(&insns[0])),
+		License:  bpfPointer(unsafe.Pointer(&lic[0])),
+	}
+	// only alphanumeric characters and underscores are allowed
+	copy(attr.ProgName[:len(attr.ProgName)-1], "podnat")
+	fd, err := bpfCall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		attr.LogLevel = 1
+		attr.LogSize = uint32(len(log))
+		attr.LogBuf = bpfPointer(unsafe.Pointer(&log[0]))
+		if retry, retryErr := bpfCall(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); retryErr == nil {
+			fd, err = retry, nil
+		}
+	}
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(lic)
+	runtime.KeepAlive(log)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("loading program %s failed: %v\n%s", name, err, unix.ByteSliceToString(log)))
+	}
+	return fd, nil
+}
+
+// loadPrograms loads the tc programs of the object file, the references to
+// the maps are resolved by symbol name
+func loadPrograms(path string, sections []string, maps map[string]int) (map[string]int, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Machine != elf.EM_BPF || f.ByteOrder != binary.LittleEndian {
+		return nil, errors.New(fmt.Sprintf("%s is not a little endian BPF object", path))
+	}
+	symbols, err := f.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	license := "GPL"
+	if s := f.Section("license"); s != nil {
+		data, err := s.Data()
+		if err != nil {
+			return nil, err
+		}
+		license = unix.ByteSliceToString(data)
+	}
+
+	progs := make(map[string]int)
+	for _, name := range sections {
+		s := f.Section(name)
+		if s == nil {
+			return nil, errors.New(fmt.Sprintf("section %s not found in %s", name, path))
+		}
+		insns, err := s.Data()
+		if err != nil {
+			return nil, err
+		}
+		if rel := f.Section(".rel" + name); rel != nil {
+			data, err := rel.Data()
+			if err != nil {
+				return nil, err
+			}
+			// Elf64_Rel entries, f.Symbols() skips the null symbol
+			for i := 0; i+16 <= len(data); i += 16 {
+				offset := binary.LittleEndian.Uint64(data[i:])
+				sym := int(elf.R_SYM64(binary.LittleEndian.Uint64(data[i+8:]))) - 1
+				if sym < 0 || sym >= len(symbols) {
+					return nil, errors.New(fmt.Sprintf("invalid relocation in section %s", name))
+				}
+				fd, ok := maps[symbols[sym].Name]
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("unknown reference %s in section %s", symbols[sym].Name, name))
+				}
+				if offset+16 > uint64(len(insns)) || insns[offset] != bpfLoadImm64 {
+					return nil, errors.New(fmt.Sprintf("unexpected instruction for %s in section %s", symbols[sym].Name, name))
+				}
+				insns[offset+1] = insns[offset+1]&0x0f | unix.BPF_PSEUDO_MAP_FD<<4
+				binary.LittleEndian.PutUint32(insns[offset+4:], uint32(fd))
+			}
+		}
+		fd, err := loadProgram(name, insns, license)
+		if err != nil {
+			for _, fd := range progs {
+				unix.Close(fd)
+			}
+			return nil, err
+		}
+		progs[name] = fd
+	}
+	return progs, nil
+}
+
+// attachPrograms adds the clsact qdisc and the ingress and egress filters,
+// the returned function removes the filters again
+func attachPrograms(iface string, ingress, egress int) (func() error, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	// the qdisc might be in use by others already, e.g. by cilium
+	if err := netlink.QdiscAdd(qdisc); err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, errors.New(fmt.Sprintf("adding clsact qdisc to %s failed: %v", iface, err))
+	}
+
+	var filters []*netlink.BpfFilter
+	for _, p := range []struct {
+		parent uint32
+		fd     int
+	}{{netlink.HANDLE_MIN_INGRESS, ingress}, {netlink.HANDLE_MIN_EGRESS, egress}} {
+		filter := &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: link.Attrs().Index,
+				Parent:    p.parent,
+				Handle:    ebpfFilterHandle,
+				Protocol:  unix.ETH_P_ALL,
+				Priority:  ebpfFilterPriority,
+			},
+			Fd:           p.fd,
+			Name:         common.ResourcePrefix,
+			DirectAction: true,
+		}
+		if err := netlink.FilterReplace(filter); err != nil {
+			return nil, errors.New(fmt.Sprintf("attaching program to %s failed: %v", iface, err))
+		}
+		filters = append(filters, filter)
+	}
+
+	return func() error {
+		for _, filter := range filters {
+			if err := netlink.FilterDel(filter); err != nil && !errors.Is(err, unix.ENOENT) {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// NewEBPFProcessor loads the tc programs from -ebpfObject and attaches them
+// to -ebpfInterface or the interface of the public node IP. The maps are pinned below -ebpfPinPath, so mappings
+// survive controller restarts like iptables rules do.
+func NewEBPFProcessor(remoteState state.StateStore) (*EBPFProcessor, error) {
+	if common.DryRun {
+		proc := newEBPFProcessor(remoteState, newMemMap(), newMemMap())
+		return proc, proc.init()
+	}
+
+	maps := make(map[string]int)
+	var opened []*sysMap
+	for _, name := range []string{"podnat_dnat", "podnat_snat"} {
+		m, err := openMap(filepath.Join(common.EBPFPinPath, name))
+		if err != nil {
+			return nil, err
+		}
+		maps[name] = m.fd
+		opened = append(opened, m)
+	}
+
+	progs, err := loadPrograms(common.EBPFObject, []string{"tc/ingress", "tc/egress"}, maps)
+	if err != nil {
+		return nil, err
+	}
+	// the filters keep a reference to the programs
+	defer func() {
+		for _, fd := range progs {
+			unix.Close(fd)
+		}
+	}()
+	iface := common.EBPFInterface
+	if iface == "" {
+		if iface, err = common.PublicInterface(); err != nil {
+			return nil, errors.New(fmt.Sprintf("ebpf interface: %v", err))
+		}
+	}
+	detach, err := attachPrograms(iface, progs["tc/ingress"], progs["tc/egress"])
+	if err != nil {
+		return nil, err
+	}
+
+	proc := newEBPFProcessor(remoteState, opened[0], opened[1])
+	proc.detach = func() error {
+		if err := detach(); err != nil {
+			return err
+		}
+		// the open maps stay usable for removing the entries
+		for name := range maps {
+			if err := os.Remove(filepath.Join(common.EBPFPinPath, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	return proc, proc.init()
+}
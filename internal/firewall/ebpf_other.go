@@ -0,0 +1,12 @@
+//go:build !linux
+
+package firewall
+
+import (
+	"errors"
+	"github.com/gutmensch/podnat-controller/internal/state"
+)
+
+func NewEBPFProcessor(remoteState state.StateStore) (*EBPFProcessor, error) {
+	return nil, errors.New("the ebpf firewall flavor is only supported on linux")
+}
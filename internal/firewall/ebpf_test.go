@@ -0,0 +1,176 @@
+package firewall
+
+import (
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"testing"
+	"time"
+)
+
+// countingMap counts the updates and deletes reaching the map
+type countingMap struct {
+	*memMap
+	changes int
+}
+
+func (m *countingMap) Update(key, value natEntry) error {
+	m.changes++
+	return m.memMap.Update(key, value)
+}
+
+func (m *countingMap) Delete(key natEntry) error {
+	m.changes++
+	return m.memMap.Delete(key)
+}
+
+func gameServer(event string, ip string) *api.PodInfo {
+	return &api.PodInfo{
+		Event:     event,
+		Name:      "game-" + ip,
+		Namespace: "games",
+		Annotation: &api.PodNATAnnotation{
+			TableEntries: []api.NATDefinition{{SourcePort: 27015, DestinationPort: 7777, Protocol: "udp", Weight: 1}},
+		},
+		IPv4: common.ParseIP(ip),
+	}
+}
+
+func TestNATEntryLayout(t *testing.T) {
+	key := natKey{Addr: [4]byte{1, 2, 3, 4}, Port: 27015, Proto: protoUDP}.entry()
+	if key != (natEntry{1, 2, 3, 4, 0x69, 0x87, 17, 0}) {
+		t.Fatalf(`natKey = %v, want network byte order`, key)
+	}
+	value := natValue{Addr: [4]byte{10, 0, 0, 5}, Port: 7777}.entry()
+	if value != (natEntry{10, 0, 0, 5, 0x1e, 0x61, 0, 0}) {
+		t.Fatalf(`natValue = %v, want network byte order`, value)
+	}
+	if key.String() != "1.2.3.4:27015/17" {
+		t.Fatalf(`natEntry.String() = %s`, key)
+	}
+}
+
+func TestEBPFApplyUpdatesMaps(t *testing.T) {
+	common.RuleStaleness = 600
+	common.RuleExpiryInterval = 60
+	dnat, snat := &countingMap{memMap: newMemMap()}, &countingMap{memMap: newMemMap()}
+	proc := newEBPFProcessor(stateMock{}, dnat, snat)
+	proc.publicNodeIP = common.ParseIP("1.2.3.4")
+
+	public := natKey{Addr: [4]byte{1, 2, 3, 4}, Port: 27015, Proto: protoUDP}.entry()
+	if err := proc.Apply(gameServer("add", "10.0.0.5")); err != nil {
+		t.Fatal(err)
+	}
+	pod := natKey{Addr: [4]byte{10, 0, 0, 5}, Port: 7777, Proto: protoUDP}.entry()
+	if v := dnat.entries[public]; v != (natValue{Addr: [4]byte{10, 0, 0, 5}, Port: 7777}).entry() {
+		t.Fatalf(`dnat[%s] = %s, want 10.0.0.5:7777`, public, v)
+	}
+	if v := snat.entries[pod]; v != (natValue{Addr: [4]byte{1, 2, 3, 4}, Port: 27015}).entry() {
+		t.Fatalf(`snat[%s] = %s, want 1.2.3.4:27015`, pod, v)
+	}
+
+	// refreshes of the same pod leave the maps alone
+	dnat.changes, snat.changes = 0, 0
+	if err := proc.Apply(gameServer("update", "10.0.0.5")); err != nil {
+		t.Fatal(err)
+	}
+	if dnat.changes != 0 || snat.changes != 0 {
+		t.Fatalf(`refresh made %d/%d map changes, want none`, dnat.changes, snat.changes)
+	}
+
+	// a replacement pod takes over the public port
+	time.Sleep(time.Millisecond)
+	if err := proc.Apply(gameServer("add", "10.0.0.6")); err != nil {
+		t.Fatal(err)
+	}
+	if v := dnat.entries[public]; v != (natValue{Addr: [4]byte{10, 0, 0, 6}, Port: 7777}).entry() {
+		t.Fatalf(`dnat[%s] = %s after replacement, want 10.0.0.6:7777`, public, v)
+	}
+	if _, ok := snat.entries[pod]; ok || len(snat.entries) != 1 {
+		t.Fatalf(`snat = %v after replacement, want only the new pod`, snat.entries)
+	}
+
+	// deleted pods are stale right away
+	if err := proc.Apply(gameServer("delete", "10.0.0.6")); err != nil {
+		t.Fatal(err)
+	}
+	if len(dnat.entries) != 0 || len(snat.entries) != 0 || len(proc.rules) != 0 {
+		t.Fatalf(`maps after delete = %v/%v, rules %v, want empty`, dnat.entries, snat.entries, proc.rules)
+	}
+}
+
+func TestEBPFReconcileRemovesUnknownEntries(t *testing.T) {
+	common.RuleStaleness = 600
+	dnat, snat := newMemMap(), newMemMap()
+	// left over in the pinned maps from a previous run
+	stale := natKey{Addr: [4]byte{1, 2, 3, 4}, Port: 25, Proto: protoTCP}.entry()
+	_ = dnat.Update(stale, natValue{Addr: [4]byte{10, 0, 0, 9}, Port: 25}.entry())
+	_ = snat.Update(natKey{Addr: [4]byte{10, 0, 0, 9}, Port: 25, Proto: protoTCP}.entry(), natValue{Addr: [4]byte{1, 2, 3, 4}, Port: 25}.entry())
+
+	proc := newEBPFProcessor(stateMock{}, dnat, snat)
+	proc.rules["1.2.3.4:143"] = []*api.NATRule{{
+		Protocol:        "tcp",
+		SourceIP:        common.ParseIP("1.2.3.4"),
+		SourcePort:      143,
+		DestinationIP:   common.ParseIP("10.0.0.3"),
+		DestinationPort: 143,
+		Created:         time.Now(),
+		LastVerified:    time.Now(),
+	}}
+	if err := proc.reconcileMaps(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := dnat.entries[stale]; ok || len(dnat.entries) != 1 || len(snat.entries) != 1 {
+		t.Fatalf(`maps = %v/%v, want only 1.2.3.4:143`, dnat.entries, snat.entries)
+	}
+
+	if err := proc.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if len(dnat.entries) != 0 || len(snat.entries) != 0 {
+		t.Fatalf(`maps after cleanup = %v/%v, want empty`, dnat.entries, snat.entries)
+	}
+}
+
+func TestEBPFSkipsRulesSharingPodPort(t *testing.T) {
+	common.RuleStaleness = 600
+	dnat, snat := newMemMap(), newMemMap()
+	proc := newEBPFProcessor(stateMock{}, dnat, snat)
+	// srcPort 80 and 8080 both to dstPort 80 of the same pod
+	older := natRule("10.0.0.5", 80)
+	older.Created = time.Now().Add(-time.Minute)
+	newer := natRule("10.0.0.5", 80)
+	newer.SourcePort = 8080
+	proc.rules["1.2.3.4:80"] = []*api.NATRule{older}
+	proc.rules["1.2.3.4:8080"] = []*api.NATRule{newer}
+	if err := proc.reconcileMaps(); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := natKey{Addr: [4]byte{10, 0, 0, 5}, Port: 80, Proto: protoUDP}.entry()
+	if v := snat.entries[pod]; v != (natValue{Addr: [4]byte{1, 2, 3, 4}, Port: 8080}).entry() {
+		t.Fatalf(`snat[%s] = %s, want 1.2.3.4:8080 of the latest rule`, pod, v)
+	}
+	if len(dnat.entries) != 1 {
+		t.Fatalf(`dnat = %v, want only the latest rule`, dnat.entries)
+	}
+}
+
+func TestEBPFKeepsBalancedBackendsInState(t *testing.T) {
+	common.RuleStaleness = 600
+	proc := newEBPFProcessor(&versionedState{}, newMemMap(), newMemMap())
+	rules := newBalancedRules("random", 0, 1, 1)
+	for _, rule := range rules {
+		rule.LastVerified = time.Now()
+	}
+	proc.rules["1.2.3.4:27015"] = rules
+	if err := proc.reconcileMaps(); err != nil {
+		t.Fatal(err)
+	}
+	// the maps use the latest pod, the state keeps both for other backends
+	if len(proc.rules["1.2.3.4:27015"]) != 2 || len(proc.stored.Rules["1.2.3.4:27015"]) != 2 {
+		t.Fatalf(`rules = %v, want both backends`, proc.rules["1.2.3.4:27015"])
+	}
+
+	proc.Shutdown()
+	proc.Shutdown()
+}
@@ -1,7 +1,6 @@
 package firewall
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gutmensch/podnat-controller/internal/api"
@@ -9,6 +8,7 @@ import (
 	"github.com/gutmensch/podnat-controller/internal/state"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -32,8 +32,20 @@ type IPTablesProcessor struct {
 	jumpChainRefreshDuration time.Duration
 	jumpChainPosition        map[string]int16
 	ruleStalenessDuration    time.Duration
+	ruleExpiryDuration       time.Duration
 	internalNetworks         []string
+	cni                      *cniPlugin
+	watchInterval            time.Duration
+	chainsSum                [32]byte
 	state                    state.StateStore
+	stored                   *state.State
+	base                     map[string]bool
+	balancers                map[string]string
+	lastPlan                 *Plan
+	planMutex                sync.Mutex
+	mutex                    sync.Mutex
+	stop                     chan struct{}
+	stopOnce                 sync.Once
 }
 
 type IPTablesInterface interface {
@@ -62,87 +74,10 @@ type IPTablesInterface interface {
 }
 
 func (p *IPTablesProcessor) Apply(event *api.PodInfo) error {
-	// cases
-	// 1. ip:port mapping does not exist at all and add event => simple add to slice
-	// 2. ip:port mapping does exist and delete event and same pod => simple delete from slice
-	// 3. ip:port mapping does exist and update event and same pod => update lastVerified for same pod
-	// 4. ip:port mapping does exist and add/update event from a new pod or namespace => add to slice (latest Created date will be reconciled in function)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-NATRULES:
-	for _, entry := range event.Annotation.TableEntries {
-
-		var effSourceIP *net.IPAddr
-		if entry.SourceIP != nil {
-			effSourceIP = common.ParseIP(*entry.SourceIP)
-		} else {
-			effSourceIP = p.publicNodeIP
-		}
-
-		if effSourceIP == nil {
-			klog.Warningf("could not detect source IP from annotation entry or from node, skipping entry %v\n", entry)
-			continue
-		}
-
-		key := fmt.Sprintf("%s:%d", effSourceIP, entry.SourcePort)
-
-		// case 1 - new entry
-		if _, ok := p.rules[key]; !ok {
-			klog.Warningf("creating new NAT rule for %s => %s:%d\n", key, event.IPv4, entry.DestinationPort)
-			p.rules[key] = append(p.rules[key], &api.NATRule{
-				SourceIP:        effSourceIP,
-				DestinationIP:   event.IPv4,
-				SourcePort:      entry.SourcePort,
-				DestinationPort: entry.DestinationPort,
-				Protocol:        entry.Protocol,
-				Created:         time.Now(),
-				LastVerified:    time.Now(),
-				Comment:         fmt.Sprintf("%s:%s", event.Namespace, event.Name),
-			})
-			continue
-		}
-
-		// case 2 and 3
-		for i, pod := range p.rules[key] {
-			if pod.DestinationIP.String() == event.IPv4.String() && pod.DestinationPort == entry.DestinationPort {
-				switch event.Event {
-				case "delete":
-					klog.Warningf(
-						"marking pod NAT rule for deletion %s => %s:%d (%s)\n",
-						key,
-						event.IPv4,
-						entry.DestinationPort,
-						event.Name,
-					)
-					p.rules[key][i].LastVerified = time.Now().Add(-p.ruleStalenessDuration)
-				case "update":
-					klog.Infof("refreshing pod NAT rule %s => %s:%d (%s)\n", key, event.IPv4, entry.DestinationPort, event.Name)
-					p.rules[key][i].LastVerified = time.Now()
-				}
-				continue NATRULES
-			}
-		}
-
-		// old pod entry potentially already deleted during update operation
-		// if delete we just skip to next rule
-		if event.Event == "delete" {
-			continue NATRULES
-		}
-
-		// case 4
-		klog.Infof("appending replacement NAT rule for %s => %s:%d (%s)\n", key, event.IPv4, entry.DestinationPort, event.Name)
-		p.rules[key] = append(p.rules[key], &api.NATRule{
-			SourceIP:        effSourceIP,
-			DestinationIP:   event.IPv4,
-			SourcePort:      entry.SourcePort,
-			DestinationPort: entry.DestinationPort,
-			Protocol:        entry.Protocol,
-			Created:         time.Now(),
-			LastVerified:    time.Now(),
-			Comment:         fmt.Sprintf("%s:%s", event.Namespace, event.Name),
-		})
-	}
-
-	p.syncState()
+	mergeEvent(p.rules, event, p.publicNodeIP, p.ruleStalenessDuration)
 
 	if err := p.reconcileRules(); err != nil {
 		klog.Errorf("reconciling rules failed with error: %v\n", err)
@@ -199,21 +134,28 @@ func (p *IPTablesProcessor) computeRulePosition(chain IPTablesChain, rules []str
 	return int(pos)
 }
 
+func jumpRule(chain IPTablesChain) []string {
+	return []string{"-m", "comment", "--comment", fmt.Sprintf("%s[jump_to_chain]", common.ResourcePrefix), "-j", chain.Name}
+}
+
 func (p *IPTablesProcessor) ensureJumpToChain(chain IPTablesChain) error {
 	var err error
 
-	ruleSpec := []string{
-		"-m", "comment", "--comment", fmt.Sprintf("%s[jump_to_chain]", common.ResourcePrefix), "-j", chain.Name,
-	}
+	ruleSpec := jumpRule(chain)
 	ruleSpecCmp := []string{
 		"-A", chain.ParentChain, "-m", "comment", "--comment", fmt.Sprintf("\"%s[jump_to_chain]\"", common.ResourcePrefix), "-j", chain.Name,
 	}
 
+	cmp := strings.Join(ruleSpecCmp, " ")
+
 	rules, err := p.ipt.List(chain.Table, chain.ParentChain)
 	if err != nil {
 		return err
 	}
-	rulePosition := p.computeRulePosition(chain, rules)
+	rulePosition, ok := p.cniRulePosition(chain, rules, cmp)
+	if !ok {
+		rulePosition = p.computeRulePosition(chain, rules)
+	}
 
 	// algorithm
 	// 1. list all rules in ipt default chain (ParentChain)
@@ -224,7 +166,6 @@ func (p *IPTablesProcessor) ensureJumpToChain(chain IPTablesChain) error {
 
 	ruleInList := false
 	ruleInListPosition := -1
-	cmp := strings.Join(ruleSpecCmp, " ")
 	for i, r := range rules {
 		// klog.Infof("debug: existing rule:'%s' expected rule:'%s' result:%v\n", r, cmp, r == cmp)
 		if r == cmp {
@@ -269,30 +210,75 @@ CREATE:
 	return nil
 }
 
-func (p *IPTablesProcessor) ensureDefaults(chain IPTablesChain) error {
+func internalRule(network string) []string {
+	return []string{
+		"-d", network, "-m", "comment", "--comment", fmt.Sprintf("%s[no_snat_for_internal]", common.ResourcePrefix), "-j", "RETURN",
+	}
+}
+
+// removeStaleDefaults deletes RETURN rules of networks which are no longer
+// internal, e.g. after a config reload
+func (p *IPTablesProcessor) removeStaleDefaults(chain IPTablesChain) error {
+	rules, err := p.ipt.List(chain.Table, chain.Name)
+	if err != nil {
+		return err
+	}
+	comment := fmt.Sprintf("%s[no_snat_for_internal]", common.ResourcePrefix)
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		i := slices.Index(fields, "-d")
+		if !strings.Contains(rule, comment) || i < 0 || i+1 >= len(fields) {
+			continue
+		}
+		if slices.Contains(p.internalNetworks, fields[i+1]) {
+			continue
+		}
+		klog.Infof("[chain:%s] deleting rule for network %s, which is no longer internal\n", chain.Name, fields[i+1])
+		if err := p.ipt.Delete(chain.Table, chain.Name, internalRule(fields[i+1])...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultRules returns the static rules at the top of a chain
+func (p *IPTablesProcessor) defaultRules(chain IPTablesChain) [][]string {
+	var rules [][]string
 	switch chain.ParentChain {
 	case "POSTROUTING":
 		// avoid NAT for internal network traffic
-		for i, n := range p.internalNetworks {
-			ruleSpec := []string{
-				"-d", n, "-m", "comment", "--comment", fmt.Sprintf("%s[no_snat_for_internal]", common.ResourcePrefix), "-j", "RETURN",
-			}
-			ruleExists, err := p.ipt.Exists(chain.Table, chain.Name, ruleSpec...)
-			if err != nil {
-				klog.Errorf("checking for existing rule %v in table %s failed: %v\n", ruleSpec, chain.Table, err)
-				return err
-			}
-			if ruleExists {
-				continue
-			}
-			err = p.ipt.Insert(chain.Table, chain.Name, i+1, ruleSpec...)
-			if err != nil {
-				klog.Errorf("adding rule %v in table %s failed: %v\n", ruleSpec, chain.Table, err)
-				return err
-			}
+		for _, n := range p.internalNetworks {
+			rules = append(rules, internalRule(n))
 		}
-	default:
+	}
+	return rules
+}
+
+func (p *IPTablesProcessor) ensureDefaults(chain IPTablesChain) error {
+	if chain.ParentChain == "POSTROUTING" {
+		if err := p.removeStaleDefaults(chain); err != nil {
+			return err
+		}
+	}
+	ruleSpecs := p.defaultRules(chain)
+	if len(ruleSpecs) == 0 {
 		klog.Warningf("no defaults for chain %s defined, skipping\n", chain.Name)
+		return nil
+	}
+	for i, ruleSpec := range ruleSpecs {
+		ruleExists, err := p.ipt.Exists(chain.Table, chain.Name, ruleSpec...)
+		if err != nil {
+			klog.Errorf("checking for existing rule %v in table %s failed: %v\n", ruleSpec, chain.Table, err)
+			return err
+		}
+		if ruleExists {
+			continue
+		}
+		err = p.ipt.Insert(chain.Table, chain.Name, i+1, ruleSpec...)
+		if err != nil {
+			klog.Errorf("adding rule %v in table %s failed: %v\n", ruleSpec, chain.Table, err)
+			return err
+		}
 	}
 
 	return nil
@@ -321,7 +307,26 @@ func (p *IPTablesProcessor) getRule(chain IPTablesChain, rule *api.NATRule) []st
 	return []string{}
 }
 
+// reconcileRules applies the rules and writes the state, rules deleted or
+// added by others are applied right away
 func (p *IPTablesProcessor) reconcileRules() error {
+	for round := 0; round < maxMergeRounds; round++ {
+		if err := p.reconcileOnce(); err != nil {
+			return err
+		}
+		if !p.syncState() {
+			return nil
+		}
+	}
+	return mergeRoundsExceeded()
+}
+
+func (p *IPTablesProcessor) reconcileOnce() error {
+	unchanged := p.chainsUnchanged()
+	balancers := make(map[string]*IPTablesBalancer)
+	if common.DryRun {
+		defer p.publishPlan()
+	}
 	for k, ruleList := range p.rules {
 		// get last rule
 		var _lastRuleTimestamp time.Time
@@ -335,23 +340,29 @@ func (p *IPTablesProcessor) reconcileRules() error {
 			}
 		}
 
-		for i, rule := range ruleList {
+		// balanced mappings keep all backends, otherwise the latest pod wins
+		balanced := isBalanced(ruleList)
+
+		var activeRules []*api.NATRule
+		for _, rule := range ruleList {
 			// remove stale rule entries
-			if time.Now().Sub(rule.LastVerified) >= p.ruleStalenessDuration || rule.Created.Before(_lastRuleTimestamp) {
-				for _, chain := range p.chains {
-					klog.Infof("[chain:%s] deleting rule %v: %v\n", chain.Name, rule, p.getRule(chain, rule))
-					if common.DryRun {
-						klog.Infof("dry-run activated, not deleting rule: %v\n", rule)
-						continue
-					}
-					err := p.ipt.DeleteIfExists(chain.Table, chain.Name, p.getRule(chain, rule)...)
-					if err != nil {
-						klog.Warningf("failed deleting stale rule %v: %v\n", rule, err)
-					}
+			if !p.isStale(rule) && (balanced || !rule.Created.Before(_lastRuleTimestamp)) {
+				activeRules = append(activeRules, rule)
+				continue
+			}
+			for _, chain := range p.chains {
+				klog.Infof("[chain:%s] deleting rule %v: %v\n", chain.Name, rule, p.getRule(chain, rule))
+				if common.DryRun {
+					klog.Infof("dry-run activated, not deleting rule: %v\n", rule)
+					continue
+				}
+				err := p.ipt.DeleteIfExists(chain.Table, chain.Name, p.getRule(chain, rule)...)
+				if err != nil {
+					klog.Warningf("failed deleting stale rule %v: %v\n", rule, err)
 				}
-				p.rules[k] = remove(p.rules[k], i)
 			}
 		}
+		p.rules[k] = activeRules
 
 		// empty NAT mapping - delete
 		if len(p.rules[k]) == 0 {
@@ -360,6 +371,30 @@ func (p *IPTablesProcessor) reconcileRules() error {
 			continue
 		}
 
+		if balanced && len(p.rules[k]) > 1 {
+			b := newIPTablesBalancer(k, p.rules[k])
+			balancers[b.Chain] = b
+			for _, chain := range p.chains {
+				// DNAT is handled in the balancer chain
+				if chain.ParentChain == "PREROUTING" {
+					continue
+				}
+				for _, rule := range p.rules[k] {
+					if common.DryRun {
+						klog.Warningf("dry-run activated, not applying rule: %v in chain %s\n", rule, chain.Name)
+						continue
+					}
+					err := p.ipt.AppendUnique(chain.Table, chain.Name, p.getRule(chain, rule)...)
+					if err != nil {
+						return errors.New(
+							fmt.Sprintf("failed appending rule for balanced rule '%v' in chain '%s': %v\n", rule, chain.Name, err),
+						)
+					}
+				}
+			}
+			continue
+		}
+
 		rule := p.rules[k][0]
 		if len(p.rules[k]) > 1 {
 			klog.Warningf("unexpected conflicting entries, choosing first in list: %v\n", rule)
@@ -378,77 +413,184 @@ func (p *IPTablesProcessor) reconcileRules() error {
 		}
 	}
 
-	p.syncState()
+	for _, chain := range p.chains {
+		if chain.ParentChain != "PREROUTING" {
+			continue
+		}
+		if err := p.reconcileBalancers(balancers, chain); err != nil {
+			return errors.New(fmt.Sprintf("failed reconciling balancer chains: %v\n", err))
+		}
+	}
+
+	if unchanged {
+		p.recordChains()
+	}
 
 	return nil
 }
 
-func remove(s []*api.NATRule, index int) []*api.NATRule {
-	return append(s[:index], s[index+1:]...)
+func (p *IPTablesProcessor) isStale(rule *api.NATRule) bool {
+	return time.Since(rule.LastVerified) >= p.ruleStalenessDuration
 }
 
-func (p *IPTablesProcessor) fetchState() {
-	bytes, err := p.state.Get()
-	if err != nil {
-		klog.Warningf("could not read remote state: %v\n", err)
-		goto empty
-	}
-	err = json.Unmarshal(bytes, &p.rules)
-	if err != nil {
-		klog.Warningf("state format malformed: %v\n%v\n", string(bytes), err)
-		goto empty
+// informer events only arrive on changes and resyncs, so expire
+// rules periodically to get rid of them even when no event is coming
+func (p *IPTablesProcessor) expireRules() {
+	for {
+		p.mutex.Lock()
+		expiry := p.ruleExpiryDuration
+		p.mutex.Unlock()
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(expiry):
+		}
+		p.mutex.Lock()
+		if err := p.reconcileRules(); err != nil {
+			klog.Warningf("expiring stale rules failed with error: %v\n", err)
+		}
+		p.mutex.Unlock()
 	}
-	return
+}
 
-empty:
-	p.rules = make(map[string][]*api.NATRule)
+// Shutdown stops the background loops and writes the state a last time,
+// the rules stay in place.
+func (p *IPTablesProcessor) Shutdown() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.syncState()
 }
 
-func (p *IPTablesProcessor) syncState() {
-	// since LastVerified is updated every informer loop we
-	// need to write the state basically every time
-	err := p.state.Put(p.rules)
-	if err != nil {
-		klog.Warningf("could not sync to remote state: %v\n", err)
-	}
+func (p *IPTablesProcessor) fetchState() {
+	p.stored = loadState(p.state)
+	p.rules = p.stored.Rules
+	p.base = ruleIDs(p.rules)
 }
 
-func (p *IPTablesProcessor) init() error {
-	p.fetchState()
-	p.publicNodeIP, _ = common.GetPublicIPAddress(4)
-	p.ruleStalenessDuration, _ = time.ParseDuration("600s")
-	p.jumpChainRefreshDuration, _ = time.ParseDuration("300s")
-	p.internalNetworks = []string{"172.16.0.0/12", "192.168.0.0/16", "10.0.0.0/8", "127.0.0.0/8"}
-	p.jumpChainPosition = map[string]int16{
-		"FORWARD":     common.ParseJumpPos(common.IptablesJump, 0),
-		"PREROUTING":  common.ParseJumpPos(common.IptablesJump, 1),
-		"POSTROUTING": common.ParseJumpPos(common.IptablesJump, 2),
+// syncState writes the rules, returns true if changes of others were merged
+// and have to be reconciled
+func (p *IPTablesProcessor) syncState() bool {
+	// LastVerified is updated every informer loop, the controller wraps
+	// the store in a write-behind layer to coalesce those writes
+	var merged bool
+	p.base, merged = saveState(p.state, p.stored, p.base, p.rules)
+	return merged
+}
+
+// WatchState applies changes of others to the state (e.g. by the state
+// subcommand) right away instead of on the next conflicting write, until
+// changes is closed.
+func (p *IPTablesProcessor) WatchState(changes <-chan *state.State) {
+	for change := range changes {
+		p.mutex.Lock()
+		var merged bool
+		p.base, merged = mergeChange(p.stored, p.base, p.rules, change)
+		if merged {
+			if err := p.reconcileRules(); err != nil {
+				klog.Warningf("applying state changes of others failed with error: %v\n", err)
+			}
+		}
+		p.mutex.Unlock()
 	}
+}
+
+// configure sets up durations and chains from the flags without touching
+// the kernel
+func (p *IPTablesProcessor) configure() {
+	p.stop = make(chan struct{})
 
-	// positive number = actual position in chain, if not enough rules, then use last position
-	// negative number = go back from end of current list and insert there, or use last position if not enough rules
 	p.chains = []IPTablesChain{
 		{
-			Name:         strings.ToUpper(fmt.Sprintf("%s_FORWARD", common.ResourcePrefix)),
-			Table:        "filter",
-			ParentChain:  "FORWARD",
-			RulePosition: p.jumpChainPosition["FORWARD"],
+			Name:        strings.ToUpper(fmt.Sprintf("%s_FORWARD", common.ResourcePrefix)),
+			Table:       "filter",
+			ParentChain: "FORWARD",
 		},
 		{
-			Name:         strings.ToUpper(fmt.Sprintf("%s_PRE", common.ResourcePrefix)),
-			Table:        "nat",
-			ParentChain:  "PREROUTING",
-			RulePosition: p.jumpChainPosition["PREROUTING"],
+			Name:        strings.ToUpper(fmt.Sprintf("%s_PRE", common.ResourcePrefix)),
+			Table:       "nat",
+			ParentChain: "PREROUTING",
 		},
 		{
-			Name:         strings.ToUpper(fmt.Sprintf("%s_POST", common.ResourcePrefix)),
-			Table:        "nat",
-			ParentChain:  "POSTROUTING",
-			RulePosition: p.jumpChainPosition["POSTROUTING"],
+			Name:        strings.ToUpper(fmt.Sprintf("%s_POST", common.ResourcePrefix)),
+			Table:       "nat",
+			ParentChain: "POSTROUTING",
 		},
 	}
+	p.applySettings()
+}
 
+// applySettings reads the settings which can change at runtime
+func (p *IPTablesProcessor) applySettings() {
+	p.ruleStalenessDuration = time.Duration(common.RuleStaleness) * time.Second
+	p.ruleExpiryDuration = time.Duration(common.RuleExpiryInterval) * time.Second
+	p.jumpChainRefreshDuration = time.Duration(common.JumpChainRefresh) * time.Second
+	// positive number = actual position in chain, if not enough rules, then use last position
+	// negative number = go back from end of current list and insert there, or use last position if not enough rules
+	p.jumpChainPosition = map[string]int16{
+		"FORWARD":     common.ParseJumpPos(common.IptablesJump, 0),
+		"PREROUTING":  common.ParseJumpPos(common.IptablesJump, 1),
+		"POSTROUTING": common.ParseJumpPos(common.IptablesJump, 2),
+	}
+	for i := range p.chains {
+		p.chains[i].RulePosition = p.jumpChainPosition[p.chains[i].ParentChain]
+	}
+
+	p.internalNetworks = nil
+	for _, n := range append(strings.Split(common.InternalNetworks, ","), common.DiscoveredNetworks...) {
+		if n == "" || slices.Contains(p.internalNetworks, n) {
+			continue
+		}
+		// TODO: IPv6 networks with ip6tables support
+		if ip, _, err := net.ParseCIDR(n); err != nil || ip.To4() == nil {
+			klog.V(2).Infof("skipping internal network %s, only IPv4 is supported\n", n)
+			continue
+		}
+		p.internalNetworks = append(p.internalNetworks, n)
+	}
+}
+
+// Reconfigure applies changed settings, e.g. of a reloaded config file,
+// reconciles the default rules and moves the jumps right away
+func (p *IPTablesProcessor) Reconfigure(apply func() error) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := apply(); err != nil {
+		return err
+	}
+	unchanged := p.chainsUnchanged()
+	p.applySettings()
+	if common.DryRun {
+		return nil
+	}
+	if err := p.setupCNI(); err != nil {
+		klog.Warningf("%v\n", err)
+	}
 	for _, chain := range p.chains {
+		if err := p.ensureDefaults(chain); err != nil {
+			klog.Warningf("reconciling default rules of iptables chain %s in table %s failed with error %v\n", chain.Name, chain.Table, err)
+		}
+		if err := p.ensureJumpToChain(chain); err != nil {
+			klog.Warningf("moving jump into iptables chain %s in table %s failed with error %v\n", chain.Name, chain.Table, err)
+		}
+	}
+	if unchanged {
+		p.recordChains()
+	}
+	return nil
+}
+
+func (p *IPTablesProcessor) init() error {
+	p.fetchState()
+	p.publicNodeIP, _ = common.GetPublicIPAddress(4)
+	p.configure()
+	if !common.DryRun {
+		if err := p.setupCNI(); err != nil {
+			klog.Warningf("%v, using numeric jump positions\n", err)
+		}
+	}
+
+	for i, chain := range p.chains {
 		if common.DryRun {
 			klog.Infof("dryRun mode enabled, not initializing iptables chain %s in table %s\n", chain.Name, chain.Table)
 			continue
@@ -474,8 +616,11 @@ func (p *IPTablesProcessor) init() error {
 		// XXX: the default chains are impacted by other ipt related software like cilium
 		//      run periodically to make sure rule position is always correct
 		//      otherwise we might lose source NAT mapping
-		go func(chain IPTablesChain) {
+		go func(i int) {
 			for {
+				p.mutex.Lock()
+				chain, refresh := p.chains[i], p.jumpRefreshDuration()
+				unchanged := p.chainsUnchanged()
 				if err := p.ensureJumpToChain(chain); err != nil {
 					klog.Warningf("setup jumping into iptables chain %s in table %s failed with error %v\n",
 						chain.Name,
@@ -483,10 +628,29 @@ func (p *IPTablesProcessor) init() error {
 						err,
 					)
 				}
-				time.Sleep(p.jumpChainRefreshDuration)
+				if unchanged {
+					p.recordChains()
+				}
+				p.mutex.Unlock()
+				select {
+				case <-p.stop:
+					return
+				case <-time.After(refresh):
+				}
 			}
-		}(chain)
+		}(i)
+	}
+
+	go p.expireRules()
+
+	// changes by others are repaired right away instead of on jump refresh
+	p.mutex.Lock()
+	p.watchInterval = time.Duration(common.ChainWatchInterval) * time.Second
+	if p.watchInterval > 0 && !common.DryRun {
+		p.recordChains()
+		go p.watchChains()
 	}
+	p.mutex.Unlock()
 
 	return nil
 }
@@ -499,8 +663,10 @@ func NewIpTablesProcessor(remoteState state.StateStore, mock bool) *IPTablesProc
 
 	if mock {
 		proc = &IPTablesProcessor{
-			ipt:   IPTablesMock{},
-			state: remoteState,
+			ipt:    IPTablesMock{},
+			state:  remoteState,
+			stored: state.NewState(),
+			stop:   make(chan struct{}),
 		}
 		return proc
 	}
@@ -512,6 +678,7 @@ func NewIpTablesProcessor(remoteState state.StateStore, mock bool) *IPTablesProc
 	proc = &IPTablesProcessor{
 		ipt:   ipt,
 		state: remoteState,
+		stop:  make(chan struct{}),
 	}
 
 	if err = proc.init(); err != nil {
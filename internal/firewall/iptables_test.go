@@ -1,8 +1,15 @@
 package firewall
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func (i IPTablesMock) Apply(e *api.PodInfo) error {
@@ -158,3 +165,213 @@ func TestComputeRulePosition_4_Entries(t *testing.T) {
 		}
 	}
 }
+
+type stateMock struct{}
+
+func (s stateMock) Load() (*state.State, error) { return nil, state.ErrNotFound }
+func (s stateMock) Save(st *state.State) error  { return nil }
+func (s stateMock) Delete() error               { return nil }
+
+func TestReconcileRulesExpiresStaleRules(t *testing.T) {
+
+	proc := NewIpTablesProcessor(stateMock{}, true)
+	proc.ruleStalenessDuration = 600 * time.Second
+	proc.chains = []IPTablesChain{
+		{Name: "PODNAT_PRE", Table: "nat", ParentChain: "PREROUTING"},
+	}
+
+	created := time.Now().Add(-time.Hour)
+	proc.rules = map[string][]*api.NATRule{
+		"1.2.3.4:25": {
+			{SourceIP: common.ParseIP("1.2.3.4"), DestinationIP: common.ParseIP("10.0.0.1"), Created: created, LastVerified: created},
+			{SourceIP: common.ParseIP("1.2.3.4"), DestinationIP: common.ParseIP("10.0.0.2"), Created: created, LastVerified: created},
+		},
+		"1.2.3.4:143": {
+			{SourceIP: common.ParseIP("1.2.3.4"), DestinationIP: common.ParseIP("10.0.0.3"), Created: created, LastVerified: time.Now()},
+		},
+	}
+
+	if err := proc.reconcileRules(); err != nil {
+		t.Fatalf(`reconcileRules failed: %v`, err)
+	}
+	if _, ok := proc.rules["1.2.3.4:25"]; ok {
+		t.Fatalf(`stale rules for 1.2.3.4:25 were not expired: %v`, proc.rules["1.2.3.4:25"])
+	}
+	if len(proc.rules["1.2.3.4:143"]) != 1 {
+		t.Fatalf(`verified rule for 1.2.3.4:143 was expired, want 1 rule, got %d`, len(proc.rules["1.2.3.4:143"]))
+	}
+}
+
+func TestReconcileRulesDryRunPlan(t *testing.T) {
+	common.DryRun = true
+	defer func() { common.DryRun = false }()
+	common.ResourcePrefix = "podnat"
+
+	proc := NewIpTablesProcessor(stateMock{}, true)
+	proc.ruleStalenessDuration = 600 * time.Second
+	proc.chains = []IPTablesChain{
+		{Name: "PODNAT_FORWARD", Table: "filter", ParentChain: "FORWARD"},
+		{Name: "PODNAT_PRE", Table: "nat", ParentChain: "PREROUTING"},
+	}
+
+	proc.rules = map[string][]*api.NATRule{
+		"1.2.3.4:25": {
+			{Protocol: "tcp", SourceIP: common.ParseIP("1.2.3.4"), SourcePort: 25, DestinationIP: common.ParseIP("10.0.0.1"), DestinationPort: 25, Created: time.Now(), LastVerified: time.Now().Add(-time.Hour), Comment: "mail:smtp"},
+		},
+		"1.2.3.4:143": {
+			{Protocol: "tcp", SourceIP: common.ParseIP("1.2.3.4"), SourcePort: 143, DestinationIP: common.ParseIP("10.0.0.1"), DestinationPort: 143, Created: time.Now(), LastVerified: time.Now(), Comment: "mail:imap"},
+		},
+	}
+	proc.ipt = listMock{chains: map[string][]string{
+		"FORWARD": {
+			`-A FORWARD -j KUBE-FORWARD`,
+		},
+		"PREROUTING": {
+			`-A PREROUTING -m comment --comment "podnat[jump_to_chain]" -j PODNAT_PRE`,
+		},
+		"PODNAT_FORWARD": {
+			`-A PODNAT_FORWARD -d 10.0.0.1/32 -p tcp -m conntrack --ctstate NEW -m tcp --dport 143 -m comment --comment "mail:imap" -j ACCEPT`,
+			`-A PODNAT_FORWARD -d 10.0.0.1/32 -p tcp -m conntrack --ctstate NEW -m tcp --dport 25 -m comment --comment "mail:smtp" -j ACCEPT`,
+		},
+		"PODNAT_PRE":         {},
+		"PODNAT_LB_00000001": {`-A PODNAT_LB_00000001 -j DNAT --to-destination 10.0.0.7:27015`},
+	}}
+
+	if err := proc.reconcileRules(); err != nil {
+		t.Fatalf(`reconcileRules failed: %v`, err)
+	}
+	plan := proc.Plan()
+	if plan == nil {
+		t.Fatal(`no plan published in dry-run mode`)
+	}
+	// the stale rule, the missing rule, the orphaned balancer chain and the
+	// missing jump come from the listed chains
+	expected := map[string][3]int{
+		"FORWARD":            {1, 0, 0},
+		"PREROUTING":         {0, 0, 1},
+		"PODNAT_FORWARD":     {0, 1, 1},
+		"PODNAT_PRE":         {1, 0, 0},
+		"PODNAT_LB_00000001": {0, 1, 0},
+	}
+	for name, counts := range expected {
+		chain, ok := plan.Chains[name]
+		if !ok {
+			t.Fatalf(`plan misses chain %s`, name)
+		}
+		if len(chain.Add) != counts[0] || len(chain.Delete) != counts[1] || len(chain.Keep) != counts[2] {
+			t.Fatalf(`unexpected plan for chain %s: %+v`, name, chain)
+		}
+	}
+}
+
+type jumpMock struct {
+	listMock
+	inserted *[]string
+}
+
+func (i jumpMock) Delete(table string, chain string, rulespec ...string) error { return nil }
+func (i jumpMock) Insert(table string, chain string, pos int, rulespec ...string) error {
+	*i.inserted = append(*i.inserted, fmt.Sprintf("%s %d", chain, pos))
+	return nil
+}
+
+func TestReconfigureMovesJumps(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "1,1,1"
+	common.DryRun = false
+	proc := NewIpTablesRenderer(nil)
+	var inserted []string
+	proc.ipt = jumpMock{
+		listMock: listMock{chains: map[string][]string{
+			"FORWARD": {
+				"-A FORWARD -m comment --comment \"podnat[jump_to_chain]\" -j PODNAT_FORWARD",
+				"-A FORWARD -j CILIUM_FORWARD",
+				"-A FORWARD -j ACCEPT",
+			},
+			"PREROUTING":  {"-A PREROUTING -m comment --comment \"podnat[jump_to_chain]\" -j PODNAT_PRE"},
+			"POSTROUTING": {"-A POSTROUTING -m comment --comment \"podnat[jump_to_chain]\" -j PODNAT_POST"},
+		}},
+		inserted: &inserted,
+	}
+
+	err := proc.Reconfigure(func() error {
+		common.IptablesJump = "-1,1,1"
+		common.JumpChainRefresh = 30
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(inserted, []string{"FORWARD 3"}) {
+		t.Fatalf(`inserted jumps = %v, want [FORWARD 3]`, inserted)
+	}
+	if chain, refresh := proc.chains[0], proc.jumpRefreshDuration(); chain.RulePosition != -1 || refresh != 30*time.Second {
+		t.Fatalf(`jump refresh = %d/%v, want -1/30s`, chain.RulePosition, refresh)
+	}
+
+	inserted = nil
+	if err := proc.Reconfigure(func() error { return errors.New("invalid") }); err == nil || len(inserted) != 0 {
+		t.Fatalf(`failed reconfigure = %v, inserted %v`, err, inserted)
+	}
+}
+
+type defaultsMock struct {
+	listMock
+	changed *[]string
+}
+
+func (i defaultsMock) Exists(table string, chain string, rulespec ...string) (bool, error) {
+	for _, rule := range i.chains[chain] {
+		if strings.Contains(rule, strings.Join(rulespec[:2], " ")) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+func (i defaultsMock) Delete(table string, chain string, rulespec ...string) error {
+	*i.changed = append(*i.changed, "-"+rulespec[1])
+	return nil
+}
+func (i defaultsMock) Insert(table string, chain string, pos int, rulespec ...string) error {
+	if rulespec[len(rulespec)-1] == "RETURN" {
+		*i.changed = append(*i.changed, "+"+rulespec[1])
+	}
+	return nil
+}
+
+func TestReconfigureInternalNetworks(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "-2,-2,-2"
+	common.InternalNetworks = "10.0.0.0/8,192.168.0.0/16"
+	common.DryRun = false
+	proc := NewIpTablesRenderer(nil)
+	var changed []string
+	proc.ipt = defaultsMock{
+		listMock: listMock{chains: map[string][]string{
+			"PODNAT_POST": {
+				"-A PODNAT_POST -d 10.0.0.0/8 -m comment --comment \"podnat[no_snat_for_internal]\" -j RETURN",
+				"-A PODNAT_POST -d 192.168.0.0/16 -m comment --comment \"podnat[no_snat_for_internal]\" -j RETURN",
+				"-A PODNAT_POST -s 10.0.0.5/32 -p tcp -m comment --comment mail:mail -j SNAT --to-source 1.2.3.4",
+			},
+		}},
+		changed: &changed,
+	}
+
+	err := proc.Reconfigure(func() error {
+		common.InternalNetworks = "10.0.0.0/8,100.64.0.0/10"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"-192.168.0.0/16", "+100.64.0.0/10"}) {
+		t.Fatalf(`changed internal networks = %v, want [-192.168.0.0/16 +100.64.0.0/10]`, changed)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	proc := NewIpTablesProcessor(&versionedState{}, true)
+	proc.rules = make(map[string][]*api.NATRule)
+	proc.Shutdown()
+	proc.Shutdown()
+}
@@ -0,0 +1,93 @@
+package firewall
+
+import (
+	"encoding/json"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"k8s.io/klog/v2"
+)
+
+// ChainPlan lists the rule specs a reconcile would add, delete or keep
+// in one chain, if dry-run was disabled.
+type ChainPlan struct {
+	Table  string     `json:"table"`
+	Add    [][]string `json:"add"`
+	Delete [][]string `json:"delete"`
+	Keep   [][]string `json:"keep"`
+}
+
+type Plan struct {
+	NodeID    string                `json:"nodeID"`
+	Generated time.Time             `json:"generated"`
+	Chains    map[string]*ChainPlan `json:"chains"`
+}
+
+func newPlan() *Plan {
+	return &Plan{
+		NodeID:    common.NodeID,
+		Generated: time.Now(),
+		Chains:    make(map[string]*ChainPlan),
+	}
+}
+
+func (p *Plan) chain(table, name string) *ChainPlan {
+	if _, ok := p.Chains[name]; !ok {
+		p.Chains[name] = &ChainPlan{
+			Table:  table,
+			Add:    [][]string{},
+			Delete: [][]string{},
+			Keep:   [][]string{},
+		}
+	}
+	return p.Chains[name]
+}
+
+// planJumps adds the jumps from the parent chains into the podnat chains
+func (p *IPTablesProcessor) planJumps(plan *Plan) error {
+	for _, chain := range p.chains {
+		rules, err := p.ipt.List(chain.Table, chain.ParentChain)
+		if err != nil {
+			return err
+		}
+		c := plan.chain(chain.Table, chain.ParentChain)
+		jump := jumpRule(chain)
+		if slices.Contains(rules, ruleLine(chain.ParentChain, jump)) {
+			c.Keep = append(c.Keep, jump)
+			continue
+		}
+		c.Add = append(c.Add, jump)
+	}
+	return nil
+}
+
+// publishPlan makes the plan of the finished reconcile available, it is
+// built from the listed chains, so rules and balancer chains unknown to the
+// state, missing defaults and missing jumps show up too
+func (p *IPTablesProcessor) publishPlan() {
+	plan, err := p.Diff()
+	if err == nil {
+		err = p.planJumps(plan)
+	}
+	if err != nil {
+		klog.Warningf("could not compute dry-run plan: %v\n", err)
+		return
+	}
+	data, err := json.Marshal(plan)
+	if err != nil {
+		klog.Warningf("could not encode dry-run plan: %v\n", err)
+	} else {
+		klog.Infof("dry-run plan: %s\n", string(data))
+	}
+	p.planMutex.Lock()
+	p.lastPlan = plan
+	p.planMutex.Unlock()
+}
+
+// Plan returns the plan of the last reconcile in dry-run mode or nil.
+func (p *IPTablesProcessor) Plan() *Plan {
+	p.planMutex.Lock()
+	defer p.planMutex.Unlock()
+	return p.lastPlan
+}
@@ -0,0 +1,135 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// renderState keeps the rules in memory only
+type renderState struct{}
+
+func (s renderState) Load() (*state.State, error) { return nil, state.ErrNotFound }
+func (s renderState) Save(st *state.State) error  { return nil }
+func (s renderState) Delete() error               { return nil }
+
+type renderedChain struct {
+	Table string
+	Name  string
+	Rules [][]string
+}
+
+// NewIpTablesRenderer returns a processor without kernel access, pod events
+// applied to it are rendered with Render instead of being executed.
+func NewIpTablesRenderer(nodeIP *net.IPAddr) *IPTablesProcessor {
+	proc := &IPTablesProcessor{
+		ipt:          IPTablesMock{},
+		state:        renderState{},
+		stored:       state.NewState(),
+		rules:        make(map[string][]*api.NATRule),
+		publicNodeIP: nodeIP,
+	}
+	proc.configure()
+	return proc
+}
+
+// renderChains returns the chain content the reconcile would create, the
+// jumps from the parent chains are positioned at runtime and not included
+func (p *IPTablesProcessor) renderChains() []renderedChain {
+	var keys []string
+	for k := range p.rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var chains []renderedChain
+	var balancers []renderedChain
+	for _, chain := range p.chains {
+		rendered := renderedChain{Table: chain.Table, Name: chain.Name, Rules: p.defaultRules(chain)}
+		for _, k := range keys {
+			rules := p.rules[k]
+			if len(rules) == 0 {
+				continue
+			}
+			if isBalanced(rules) && len(rules) > 1 {
+				if chain.ParentChain == "PREROUTING" {
+					b := newIPTablesBalancer(k, rules)
+					rendered.Rules = append(rendered.Rules, b.Jump)
+					balancers = append(balancers, renderedChain{Table: chain.Table, Name: b.Chain, Rules: b.Rules})
+					continue
+				}
+				for _, rule := range rules {
+					rendered.Rules = append(rendered.Rules, p.getRule(chain, rule))
+				}
+				continue
+			}
+			rendered.Rules = append(rendered.Rules, p.getRule(chain, latestRule(rules)))
+		}
+		chains = append(chains, rendered)
+	}
+	return append(chains, balancers...)
+}
+
+// quoteArg quotes args with characters special to the shell, brackets are
+// quoted too, so comments like podnat[jump_to_chain] are no glob patterns
+func quoteArg(arg string, quote func(string) string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:/,=+", r))
+	}) < 0 {
+		return arg
+	}
+	return quote(arg)
+}
+
+func joinArgs(spec []string, quote func(string) string) string {
+	var args []string
+	for _, arg := range spec {
+		args = append(args, quoteArg(arg, quote))
+	}
+	return strings.Join(args, " ")
+}
+
+// Render writes the rules as iptables commands (format "rules") or as
+// input for iptables-restore --noflush (format "restore").
+func (p *IPTablesProcessor) Render(w io.Writer, format string) error {
+	chains := p.renderChains()
+
+	switch format {
+	case "rules":
+		shellQuote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" }
+		for _, chain := range chains {
+			fmt.Fprintf(w, "iptables -t %s -N %s\n", chain.Table, chain.Name)
+			for _, rule := range chain.Rules {
+				fmt.Fprintf(w, "iptables -t %s -A %s %s\n", chain.Table, chain.Name, joinArgs(rule, shellQuote))
+			}
+		}
+	case "restore":
+		restoreQuote := func(s string) string { return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"` }
+		for _, table := range []string{"filter", "nat"} {
+			fmt.Fprintf(w, "*%s\n", table)
+			for _, chain := range chains {
+				if chain.Table == table {
+					fmt.Fprintf(w, ":%s - [0:0]\n", chain.Name)
+				}
+			}
+			for _, chain := range chains {
+				if chain.Table != table {
+					continue
+				}
+				for _, rule := range chain.Rules {
+					fmt.Fprintf(w, "-A %s %s\n", chain.Name, joinArgs(rule, restoreQuote))
+				}
+			}
+			fmt.Fprintf(w, "COMMIT\n")
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown render format %s, use rules or restore", format))
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package firewall
+
+import (
+	"bytes"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"strings"
+	"testing"
+)
+
+func TestRenderRestore(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "-2,-2,-2"
+	common.RuleStaleness = 600
+	common.InternalNetworks = "10.0.0.0/8,fd00::/8"
+	proc := NewIpTablesRenderer(common.ParseIP("1.2.3.4"))
+	err := proc.Apply(&api.PodInfo{
+		Event:     "add",
+		Name:      "mail",
+		Namespace: "mail",
+		Annotation: &api.PodNATAnnotation{
+			TableEntries: []api.NATDefinition{{SourcePort: 25, DestinationPort: 2525, Protocol: "tcp", Weight: 1}},
+		},
+		IPv4: common.ParseIP("10.0.0.5"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := proc.Render(&out, "restore"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"*filter",
+		":PODNAT_PRE - [0:0]",
+		"-A PODNAT_FORWARD -d 10.0.0.5/32 -p tcp -m conntrack --ctstate NEW -m tcp --dport 2525 -m comment --comment mail:mail -j ACCEPT",
+		"-A PODNAT_PRE -d 1.2.3.4/32 -p tcp -m tcp --dport 25 -m comment --comment mail:mail -j DNAT --to-destination 10.0.0.5:2525",
+		"-A PODNAT_POST -d 10.0.0.0/8 -m comment --comment \"podnat[no_snat_for_internal]\" -j RETURN",
+		"-A PODNAT_POST -s 10.0.0.5/32 -p tcp -m comment --comment mail:mail -j SNAT --to-source 1.2.3.4",
+		"COMMIT",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("rendered output is missing line %s:\n%s", line, out.String())
+		}
+	}
+
+	if strings.Contains(out.String(), "fd00::/8") {
+		t.Fatalf("rendered output contains IPv6 network:\n%s", out.String())
+	}
+
+	if err := proc.Render(&out, "nft"); err == nil {
+		t.Fatal(`expected error for unknown format`)
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	shellQuote := func(s string) string { return "'" + s + "'" }
+	if got := joinArgs([]string{"--comment", "a b", ""}, shellQuote); got != "--comment 'a b' ''" {
+		t.Fatalf(`joinArgs = %s`, got)
+	}
+	if got := joinArgs([]string{"--comment", "podnat[jump_to_chain]"}, shellQuote); got != "--comment 'podnat[jump_to_chain]'" {
+		t.Fatalf(`joinArgs = %s`, got)
+	}
+}
@@ -0,0 +1,217 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"net"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// mergeEvent updates the NAT rules of all backends from a pod event, stale
+// and replaced rules are removed by the reconcile of the processor
+func mergeEvent(rules map[string][]*api.NATRule, event *api.PodInfo, publicNodeIP *net.IPAddr, staleness time.Duration) {
+	// cases
+	// 1. ip:port mapping does not exist at all and add event => simple add to slice
+	// 2. ip:port mapping does exist and delete event and same pod => simple delete from slice
+	// 3. ip:port mapping does exist and add/update event and same pod => update lastVerified and balancing for same pod
+	// 4. ip:port mapping does exist and add/update event from a new pod or namespace => add to slice (latest Created date will be reconciled in function)
+NATRULES:
+	for _, entry := range event.Annotation.TableEntries {
+
+		var effSourceIP *net.IPAddr
+		if entry.SourceIP != nil {
+			effSourceIP = common.ParseIP(*entry.SourceIP)
+		} else {
+			effSourceIP = publicNodeIP
+		}
+
+		if effSourceIP == nil {
+			klog.Warningf("could not detect source IP from annotation entry or from node, skipping entry %v\n", entry)
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%d", effSourceIP, entry.SourcePort)
+
+		// case 1 - new entry
+		if _, ok := rules[key]; !ok {
+			klog.Warningf("creating new NAT rule for %s => %s:%d\n", key, event.IPv4, entry.DestinationPort)
+			rules[key] = append(rules[key], &api.NATRule{
+				SourceIP:        effSourceIP,
+				DestinationIP:   event.IPv4,
+				SourcePort:      entry.SourcePort,
+				DestinationPort: entry.DestinationPort,
+				Protocol:        entry.Protocol,
+				Created:         time.Now(),
+				LastVerified:    time.Now(),
+				Comment:         fmt.Sprintf("%s:%s", event.Namespace, event.Name),
+				Balance:         entry.Balance,
+				Weight:          entry.Weight,
+				Sticky:          entry.Sticky,
+			})
+			continue
+		}
+
+		// case 2 and 3
+		for i, pod := range rules[key] {
+			if pod.DestinationIP.String() == event.IPv4.String() && pod.DestinationPort == entry.DestinationPort {
+				switch event.Event {
+				case "delete":
+					klog.Warningf(
+						"marking pod NAT rule for deletion %s => %s:%d (%s)\n",
+						key,
+						event.IPv4,
+						entry.DestinationPort,
+						event.Name,
+					)
+					rules[key][i].LastVerified = time.Now().Add(-staleness)
+				case "add", "update":
+					klog.Infof("refreshing pod NAT rule %s => %s:%d (%s)\n", key, event.IPv4, entry.DestinationPort, event.Name)
+					rules[key][i].LastVerified = time.Now()
+					rules[key][i].Balance = entry.Balance
+					rules[key][i].Weight = entry.Weight
+					rules[key][i].Sticky = entry.Sticky
+				}
+				continue NATRULES
+			}
+		}
+
+		// old pod entry potentially already deleted during update operation
+		// if delete we just skip to next rule
+		if event.Event == "delete" {
+			continue NATRULES
+		}
+
+		// case 4
+		klog.Infof("appending replacement NAT rule for %s => %s:%d (%s)\n", key, event.IPv4, entry.DestinationPort, event.Name)
+		rules[key] = append(rules[key], &api.NATRule{
+			SourceIP:        effSourceIP,
+			DestinationIP:   event.IPv4,
+			SourcePort:      entry.SourcePort,
+			DestinationPort: entry.DestinationPort,
+			Protocol:        entry.Protocol,
+			Created:         time.Now(),
+			LastVerified:    time.Now(),
+			Comment:         fmt.Sprintf("%s:%s", event.Namespace, event.Name),
+			Balance:         entry.Balance,
+			Weight:          entry.Weight,
+			Sticky:          entry.Sticky,
+		})
+	}
+}
+
+// loadState returns the stored rules of the node or an empty state
+func loadState(store state.StateStore) *state.State {
+	stored, err := store.Load()
+	if errors.Is(err, state.ErrNotFound) {
+		klog.Infof("no remote state found, starting without rules\n")
+		return state.NewState()
+	} else if err != nil {
+		klog.Warningf("could not read remote state: %v\n", err)
+		// keep the revision unknown, the first write reports the conflict
+		return state.NewState()
+	}
+	if stored.Rules == nil {
+		stored.Rules = make(map[string][]*api.NATRule)
+	}
+	return stored
+}
+
+// ruleID identifies a backend of a mapping across state revisions
+func ruleID(key string, rule *api.NATRule) string {
+	return fmt.Sprintf("%s>%s:%d", key, rule.DestinationIP, rule.DestinationPort)
+}
+
+func ruleIDs(rules map[string][]*api.NATRule) map[string]bool {
+	ids := make(map[string]bool)
+	for key, ruleList := range rules {
+		for _, rule := range ruleList {
+			ids[ruleID(key, rule)] = true
+		}
+	}
+	return ids
+}
+
+// mergeRules applies the changes others made to the state since base.
+// Rules deleted by others are marked stale, so the next reconcile removes
+// them from the firewall too, rules added by others are taken over.
+// Returns true if rules were changed.
+func mergeRules(rules map[string][]*api.NATRule, base map[string]bool, theirs map[string][]*api.NATRule) bool {
+	changed := false
+	current := ruleIDs(theirs)
+	for key, ruleList := range rules {
+		for _, rule := range ruleList {
+			if base[ruleID(key, rule)] && !current[ruleID(key, rule)] && !rule.LastVerified.IsZero() {
+				klog.Infof("rule %s was deleted from the state by others, removing\n", ruleID(key, rule))
+				rule.LastVerified = time.Time{}
+				changed = true
+			}
+		}
+	}
+	ours := ruleIDs(rules)
+	for key, ruleList := range theirs {
+		for _, rule := range ruleList {
+			if !base[ruleID(key, rule)] && !ours[ruleID(key, rule)] {
+				klog.Infof("rule %s was added to the state by others, applying\n", ruleID(key, rule))
+				rules[key] = append(rules[key], rule)
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// mergeChange merges a watched change of the state by others into rules.
+// Returns the rule identities of the change as new base and whether rules
+// changed, which the caller has to reconcile.
+func mergeChange(stored *state.State, base map[string]bool, rules map[string][]*api.NATRule, change *state.State) (map[string]bool, bool) {
+	if change == nil {
+		klog.Warningf("remote state was deleted by others, keeping rules\n")
+		return base, false
+	}
+	klog.Infof("remote state was changed by others, merging changes\n")
+	merged := mergeRules(rules, base, change.Rules)
+	stored.Revision = change.Revision
+	return ruleIDs(change.Rules), merged
+}
+
+// maxMergeRounds limits the reconciles of changes merged from others, two
+// writers might keep changing the same state
+const maxMergeRounds = 3
+
+func mergeRoundsExceeded() error {
+	klog.Warningf("remote state still changed by others after %d merges, applying on next reconcile\n", maxMergeRounds)
+	return errors.New(fmt.Sprintf("remote state changed concurrently %d times in a row", maxMergeRounds))
+}
+
+// saveState writes the rules with the revision of stored. On a conflict the
+// current state is loaded and the changes of others (e.g. the state
+// subcommand) since base are merged into rules instead of being
+// overwritten. Returns the rule identities of the written state as new base
+// and whether the merge changed rules, which the caller has to reconcile.
+func saveState(store state.StateStore, stored *state.State, base map[string]bool, rules map[string][]*api.NATRule) (map[string]bool, bool) {
+	stored.Rules = rules
+	err := store.Save(stored)
+	merged := false
+	if errors.Is(err, state.ErrConflict) {
+		current, loadErr := store.Load()
+		if loadErr != nil {
+			klog.Warningf("remote state was changed concurrently and could not be read: %v\n", loadErr)
+			return base, false
+		}
+		klog.Warningf("remote state was changed concurrently, merging changes\n")
+		merged = mergeRules(rules, base, current.Rules)
+		base = ruleIDs(current.Rules)
+		stored.Revision = current.Revision
+		err = store.Save(stored)
+	}
+	if err != nil {
+		klog.Warningf("could not sync to remote state: %v\n", err)
+		return base, merged
+	}
+	return ruleIDs(rules), merged
+}
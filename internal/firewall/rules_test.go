@@ -0,0 +1,180 @@
+package firewall
+
+import (
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/state"
+	"testing"
+	"time"
+)
+
+// versionedState keeps one state in memory and checks the revision like
+// the real stores
+type versionedState struct {
+	current  *state.State
+	revision int
+}
+
+func (s *versionedState) Load() (*state.State, error) {
+	if s.current == nil {
+		return nil, state.ErrNotFound
+	}
+	c := *s.current
+	c.Rules = make(map[string][]*api.NATRule)
+	for key, ruleList := range s.current.Rules {
+		for _, rule := range ruleList {
+			r := *rule
+			c.Rules[key] = append(c.Rules[key], &r)
+		}
+	}
+	return &c, nil
+}
+
+func (s *versionedState) Save(st *state.State) error {
+	if s.current != nil && st.Revision != s.current.Revision || s.current == nil && st.Revision != "" {
+		return state.ErrConflict
+	}
+	s.revision++
+	st.Revision = fmt.Sprint(s.revision)
+	c := *st
+	s.current = &c
+	// copy the rules, the processor keeps modifying them
+	s.current, _ = s.Load()
+	return nil
+}
+
+func (s *versionedState) Delete() error {
+	s.current = nil
+	return nil
+}
+
+func natRule(ip string, port uint16) *api.NATRule {
+	return &api.NATRule{
+		Protocol: "udp", SourceIP: common.ParseIP("1.2.3.4"), SourcePort: port,
+		DestinationIP: common.ParseIP(ip), DestinationPort: port, Created: time.Now(), LastVerified: time.Now(),
+	}
+}
+
+func TestSaveStateMergesChangesOfOthers(t *testing.T) {
+	common.RuleStaleness = 600
+	store := &versionedState{}
+	dnat, snat := newMemMap(), newMemMap()
+	proc := newEBPFProcessor(store, dnat, snat)
+	proc.rules["1.2.3.4:27015"] = []*api.NATRule{natRule("10.0.0.5", 27015)}
+	proc.rules["1.2.3.4:27016"] = []*api.NATRule{natRule("10.0.0.6", 27016)}
+	if err := proc.reconcileMaps(); err != nil {
+		t.Fatal(err)
+	}
+
+	// e.g. state prune and put while the controller is running
+	edited, _ := store.Load()
+	delete(edited.Rules, "1.2.3.4:27015")
+	edited.Rules["1.2.3.4:27017"] = []*api.NATRule{natRule("10.0.0.7", 27017)}
+	if err := store.Save(edited); err != nil {
+		t.Fatal(err)
+	}
+
+	proc.rules["1.2.3.4:27016"][0].LastVerified = time.Now()
+	if err := proc.reconcileMaps(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := proc.rules["1.2.3.4:27015"]; ok {
+		t.Fatalf(`rule deleted by others was kept: %v`, proc.rules)
+	}
+	if _, ok := proc.rules["1.2.3.4:27017"]; !ok {
+		t.Fatalf(`rule added by others was dropped: %v`, proc.rules)
+	}
+	if len(dnat.entries) != 2 {
+		t.Fatalf(`dnat map = %v, want 27016 and 27017`, dnat.entries)
+	}
+	saved, _ := store.Load()
+	if _, ok := saved.Rules["1.2.3.4:27015"]; ok || len(saved.Rules) != 2 {
+		t.Fatalf(`saved rules = %v, want 27016 and 27017`, saved.Rules)
+	}
+}
+
+func TestWatchStateAppliesChangesOfOthers(t *testing.T) {
+	common.RuleStaleness = 600
+	store := &versionedState{}
+	dnat, snat := newMemMap(), newMemMap()
+	proc := newEBPFProcessor(store, dnat, snat)
+	proc.rules["1.2.3.4:27015"] = []*api.NATRule{natRule("10.0.0.5", 27015)}
+	proc.rules["1.2.3.4:27016"] = []*api.NATRule{natRule("10.0.0.6", 27016)}
+	if err := proc.reconcileMaps(); err != nil {
+		t.Fatal(err)
+	}
+
+	edited, _ := store.Load()
+	delete(edited.Rules, "1.2.3.4:27015")
+	edited.Rules["1.2.3.4:27017"] = []*api.NATRule{natRule("10.0.0.7", 27017)}
+	if err := store.Save(edited); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan *state.State, 2)
+	changes <- edited
+	// deletions keep the rules
+	changes <- nil
+	close(changes)
+	proc.WatchState(changes)
+
+	if _, ok := proc.rules["1.2.3.4:27015"]; ok {
+		t.Fatalf(`rule deleted by others was kept: %v`, proc.rules)
+	}
+	if len(dnat.entries) != 2 {
+		t.Fatalf(`dnat map = %v, want 27016 and 27017`, dnat.entries)
+	}
+	saved, _ := store.Load()
+	if _, ok := saved.Rules["1.2.3.4:27015"]; ok || len(saved.Rules) != 2 {
+		t.Fatalf(`saved rules = %v, want 27016 and 27017`, saved.Rules)
+	}
+}
+
+func TestMergeEventRefreshesBalancingOnAdd(t *testing.T) {
+	rules := make(map[string][]*api.NATRule)
+	event := gameServer("add", "10.0.0.5")
+	event.Annotation.TableEntries[0].SourceIP = common.Ptr("1.2.3.4")
+	mergeEvent(rules, event, nil, time.Minute)
+
+	// e.g. the pod annotation changed while the controller was down
+	event.Annotation.TableEntries[0].Balance = "nth"
+	event.Annotation.TableEntries[0].Weight = 3
+	event.Annotation.TableEntries[0].Sticky = 60
+	mergeEvent(rules, event, nil, time.Minute)
+	r := rules["1.2.3.4:27015"]
+	if len(r) != 1 || r[0].Balance != "nth" || r[0].Weight != 3 || r[0].Sticky != 60 {
+		t.Fatalf(`rules after add of existing mapping = %+v`, r)
+	}
+}
+
+// conflictingState rejects every write, every read returns a new rule of
+// another writer
+type conflictingState struct {
+	loads int
+}
+
+func (s *conflictingState) Load() (*state.State, error) {
+	s.loads++
+	st := state.NewState()
+	port := uint16(27100 + s.loads)
+	st.Rules[fmt.Sprintf("1.2.3.4:%d", port)] = []*api.NATRule{natRule(fmt.Sprintf("10.0.1.%d", s.loads), port)}
+	st.Revision = fmt.Sprint(s.loads)
+	return st, nil
+}
+
+func (s *conflictingState) Save(st *state.State) error { return state.ErrConflict }
+
+func (s *conflictingState) Delete() error { return nil }
+
+func TestReconcileStopsMergingAfterMaxRounds(t *testing.T) {
+	common.RuleStaleness = 600
+	store := &conflictingState{}
+	proc := newEBPFProcessor(store, newMemMap(), newMemMap())
+	proc.rules["1.2.3.4:27015"] = []*api.NATRule{natRule("10.0.0.5", 27015)}
+	if err := proc.reconcileMaps(); err == nil {
+		t.Fatal(`reconcileMaps() of a state changed on every write succeeded`)
+	}
+	if store.loads != maxMergeRounds {
+		t.Fatalf(`state loaded %d times, want %d`, store.loads, maxMergeRounds)
+	}
+}
@@ -0,0 +1,113 @@
+package firewall
+
+import (
+	"crypto/sha256"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"k8s.io/klog/v2"
+)
+
+// chainsChecksum hashes the parent chains with the jumps, the podnat chains
+// and the balancer chains, listing is cheap compared to waiting for the
+// jump refresh
+func (p *IPTablesProcessor) chainsChecksum() [32]byte {
+	var balancers []string
+	for chain := range p.balancers {
+		balancers = append(balancers, chain)
+	}
+	slices.Sort(balancers)
+
+	h := sha256.New()
+	for _, chain := range p.chains {
+		names := []string{chain.ParentChain, chain.Name}
+		if chain.ParentChain == "PREROUTING" {
+			names = append(names, balancers...)
+		}
+		for _, name := range names {
+			rules, err := p.ipt.List(chain.Table, name)
+			if err != nil {
+				// e.g. a deleted chain, the error differs from any content
+				h.Write([]byte(err.Error()))
+			}
+			for _, rule := range rules {
+				h.Write([]byte(rule + "\n"))
+			}
+		}
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// chainsUnchanged returns true if the chains still match the recorded ones,
+// own passes only record their changes then, otherwise changes by others
+// right before would become the baseline and never get repaired. Must be
+// called with the mutex held.
+func (p *IPTablesProcessor) chainsUnchanged() bool {
+	if p.watchInterval <= 0 || common.DryRun {
+		return false
+	}
+	return p.chainsChecksum() == p.chainsSum
+}
+
+// recordChains remembers the chains after a repair or an own pass on
+// unchanged chains, so only changes by others trigger a repair. Must be
+// called with the mutex held.
+func (p *IPTablesProcessor) recordChains() {
+	if p.watchInterval <= 0 || common.DryRun {
+		return
+	}
+	p.chainsSum = p.chainsChecksum()
+}
+
+// repairChains recreates chains, default rules and jumps and reconciles
+// the rules. Must be called with the mutex held.
+func (p *IPTablesProcessor) repairChains() {
+	// balancer chains may be flushed or deleted too, so they are all
+	// reconciled instead of only the changed ones
+	p.balancers = nil
+	for _, chain := range p.chains {
+		if err := p.ensureChain(chain); err != nil {
+			klog.Warningf("repairing iptables chain %s in table %s failed with error %v\n", chain.Name, chain.Table, err)
+			continue
+		}
+		if err := p.ensureDefaults(chain); err != nil {
+			klog.Warningf("repairing default rules of iptables chain %s in table %s failed with error %v\n", chain.Name, chain.Table, err)
+		}
+		if err := p.ensureJumpToChain(chain); err != nil {
+			klog.Warningf("repairing jump into iptables chain %s in table %s failed with error %v\n", chain.Name, chain.Table, err)
+		}
+	}
+	if err := p.reconcileRules(); err != nil {
+		klog.Warningf("reconciling rules after chain change failed with error %v\n", err)
+	}
+	p.recordChains()
+}
+
+// checkChains repairs the chains if they were changed by others, returns
+// true if a repair was needed
+func (p *IPTablesProcessor) checkChains() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.chainsChecksum() == p.chainsSum {
+		return false
+	}
+	klog.Infof("iptables chains changed outside of the controller, repairing\n")
+	p.repairChains()
+	return true
+}
+
+// watchChains compares the chains every watch interval, e.g. after another
+// program flushed or reordered the default chains
+func (p *IPTablesProcessor) watchChains() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(p.watchInterval):
+		}
+		p.checkChains()
+	}
+}
@@ -0,0 +1,112 @@
+package firewall
+
+import (
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestWatchChainsRepairsChanges(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "1,1,1"
+	common.DryRun = false
+	m := loadSaveMock(t, "kube-proxy.iptables-save")
+	proc := NewIpTablesRenderer(nil)
+	proc.ipt = m
+	proc.watchInterval = time.Second
+
+	proc.repairChains()
+	if proc.checkChains() {
+		t.Fatal(`checkChains() repaired unchanged chains`)
+	}
+
+	// e.g. a firewall service flushing the parent chains
+	*m.changes = 0
+	for _, chain := range proc.chains {
+		m.tables[chain.Table][chain.ParentChain] = nil
+	}
+	if !proc.checkChains() {
+		t.Fatal(`checkChains() missed flushed parent chains`)
+	}
+	for _, chain := range proc.chains {
+		if rules := m.tables[chain.Table][chain.ParentChain]; len(rules) != 1 || !strings.HasSuffix(rules[0], "-j "+chain.Name) {
+			t.Fatalf(`parent chain %s = %v, want jump to %s`, chain.ParentChain, rules, chain.Name)
+		}
+	}
+
+	// deleted podnat chains are recreated with their defaults
+	chain := proc.chains[2]
+	delete(m.tables[chain.Table], chain.Name)
+	i := slices.Index(m.order[chain.Table], chain.Name)
+	m.order[chain.Table] = slices.Delete(m.order[chain.Table], i, i+1)
+	if !proc.checkChains() {
+		t.Fatal(`checkChains() missed deleted chain`)
+	}
+	if len(m.tables[chain.Table][chain.Name]) != len(proc.defaultRules(chain)) {
+		t.Fatalf(`chain %s = %v, want default rules`, chain.Name, m.tables[chain.Table][chain.Name])
+	}
+
+	// own changes are not repaired again
+	*m.changes = 0
+	if proc.checkChains() || *m.changes != 0 {
+		t.Fatalf(`checkChains() after repair made %d changes, want none`, *m.changes)
+	}
+}
+
+func TestWatchChainsRepairsChangesBeforeOwnPass(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	common.IptablesJump = "1,1,1"
+	common.DryRun = false
+	common.RuleStaleness = 600
+	m := loadSaveMock(t, "kube-proxy.iptables-save")
+	proc := NewIpTablesRenderer(nil)
+	proc.ipt = m
+	proc.watchInterval = time.Second
+	proc.internalNetworks = nil
+	rules := newBalancedRules("random", 0, 1, 1)
+	for _, rule := range rules {
+		rule.LastVerified = time.Now()
+	}
+	proc.rules = map[string][]*api.NATRule{"1.2.3.4:27015": rules}
+	proc.repairChains()
+
+	// the jump is deleted right before the next reconcile of an event
+	chain := proc.chains[0]
+	m.tables[chain.Table][chain.ParentChain] = nil
+	if err := proc.reconcileRules(); err != nil {
+		t.Fatal(err)
+	}
+	if !proc.checkChains() {
+		t.Fatal(`checkChains() missed change before own reconcile`)
+	}
+	if len(m.tables[chain.Table][chain.ParentChain]) != 1 {
+		t.Fatalf(`parent chain %s = %v, want jump`, chain.ParentChain, m.tables[chain.Table][chain.ParentChain])
+	}
+
+	// e.g. iptables -t nat -F flushes the balancer chains too
+	var balancer string
+	for _, c := range proc.chains {
+		if c.ParentChain != "PREROUTING" {
+			continue
+		}
+		for name := range m.tables[c.Table] {
+			if strings.HasPrefix(name, balancerChainPrefix()) {
+				balancer = name
+			}
+			m.tables[c.Table][name] = nil
+		}
+		if !proc.checkChains() {
+			t.Fatal(`checkChains() missed flushed nat table`)
+		}
+		if len(m.tables[c.Table][balancer]) != 2 {
+			t.Fatalf(`balancer chain %s = %v, want 2 rules`, balancer, m.tables[c.Table][balancer])
+		}
+	}
+	if balancer == "" {
+		t.Fatal(`no balancer chain created`)
+	}
+}
@@ -0,0 +1,323 @@
+package floatingip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"k8s.io/klog/v2"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// AddressHandler assigns floating IPs to the local node interface.
+type AddressHandler interface {
+	AddAddress(ip net.IP) error
+	DeleteAddress(ip net.IP) error
+	Announce(ip net.IP) error
+	Addresses() ([]net.IP, error)
+}
+
+// restartOwner keeps the leases still held from a previous run until local
+// pods claim them again, it expires like a pod owner
+const restartOwner = "previous run"
+
+type claim struct {
+	ip     net.IP
+	owners map[string]time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+	mutex  sync.Mutex
+}
+
+// Manager holds one lease per floating IP claimed by local pods. Only the
+// node holding the lease assigns the IP to its interface, so the address
+// moves along with the pod like with keepalived.
+type Manager struct {
+	client        kubernetes.Interface
+	namespace     string
+	identity      string
+	addresses     AddressHandler
+	claims        map[string]*claim
+	released      map[string]*claim
+	staleness     time.Duration
+	expiry        time.Duration
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+	mutex         sync.Mutex
+	stop          chan struct{}
+	elections     sync.WaitGroup
+}
+
+func leasePrefix() string {
+	return fmt.Sprintf("%s-fip-", common.ResourcePrefix)
+}
+
+func leaseName(ip net.IP) string {
+	return leasePrefix() + strings.ReplaceAll(ip.String(), ".", "-")
+}
+
+// holds reports if lease is held by this node and not expired
+func (m *Manager) holds(lease *coordinationv1.Lease) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity != m.identity || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	return time.Since(spec.RenewTime.Time) < time.Duration(*spec.LeaseDurationSeconds)*time.Second
+}
+
+// releaseStale removes floating IPs left on the interface by a previous
+// run (e.g. after a crash), other nodes might hold their leases by now.
+// Leases still held by this node are claimed again and released with the
+// claim expiry, if no local pod claims the IP.
+func (m *Manager) releaseStale() error {
+	assigned, err := m.addresses.Addresses()
+	if err != nil {
+		return err
+	}
+	leases, err := m.client.CoordinationV1().Leases(m.namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i, lease := range leases.Items {
+		if !strings.HasPrefix(lease.Name, leasePrefix()) {
+			continue
+		}
+		ip := net.ParseIP(strings.ReplaceAll(strings.TrimPrefix(lease.Name, leasePrefix()), "-", "."))
+		if ip == nil || !slices.ContainsFunc(assigned, ip.Equal) {
+			continue
+		}
+		if m.holds(&leases.Items[i]) {
+			m.Claim(ip.String(), restartOwner)
+			continue
+		}
+		klog.Warningf("removing floating IP %s left by a previous run\n", ip)
+		if err := m.addresses.DeleteAddress(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claim registers owner (namespace/name of a pod) for the floating IP and
+// starts competing for the lease, if this is the first local owner.
+func (m *Manager) Claim(address, owner string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		klog.Warningf("ignoring invalid floating IP %s of %s\n", address, owner)
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c, ok := m.claims[ip.String()]; ok {
+		c.owners[owner] = time.Now()
+		return
+	}
+
+	klog.Infof("claiming floating IP %s for %s\n", ip, owner)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &claim{
+		ip:     ip,
+		owners: map[string]time.Time{owner: time.Now()},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.claims[ip.String()] = c
+	// the address of a released claim is removed when its election ends,
+	// which must not happen after this election assigned it again
+	previous := m.released[ip.String()]
+	m.elections.Add(1)
+	go func() {
+		defer m.elections.Done()
+		if previous != nil {
+			<-previous.done
+		}
+		m.elect(ctx, c)
+		// the claim might end before leading, e.g. with the address left
+		// by a previous run still assigned
+		c.mutex.Lock()
+		if err := m.addresses.DeleteAddress(c.ip); err != nil {
+			klog.Errorf("could not remove floating IP %s: %v\n", c.ip, err)
+		}
+		c.mutex.Unlock()
+		close(c.done)
+		m.mutex.Lock()
+		if m.released[ip.String()] == c {
+			delete(m.released, ip.String())
+		}
+		m.mutex.Unlock()
+	}()
+}
+
+// Release removes owner from the floating IP, the lease is given up and
+// the address removed as soon as no local owner is left.
+func (m *Manager) Release(address, owner string) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.claims[ip.String()]
+	if !ok {
+		return
+	}
+	delete(c.owners, owner)
+	if len(c.owners) > 0 {
+		return
+	}
+	klog.Infof("releasing floating IP %s, no local owner left\n", ip)
+	c.cancel()
+	delete(m.claims, ip.String())
+	m.released[ip.String()] = c
+}
+
+// owners without refresh (e.g. missed delete events) expire like NAT rules
+func (m *Manager) expireClaims() {
+	for {
+		m.mutex.Lock()
+		expiry := m.expiry
+		m.mutex.Unlock()
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(expiry):
+		}
+		m.mutex.Lock()
+		var expired [][2]string
+		for ip, c := range m.claims {
+			for owner, lastSeen := range c.owners {
+				if time.Since(lastSeen) >= m.staleness {
+					expired = append(expired, [2]string{ip, owner})
+				}
+			}
+		}
+		m.mutex.Unlock()
+		for _, e := range expired {
+			klog.Warningf("floating IP claim of %s for %s is stale\n", e[1], e[0])
+			m.Release(e[0], e[1])
+		}
+	}
+}
+
+// Reconfigure applies changed rule staleness and expiry settings, e.g. of a
+// reloaded config file.
+func (m *Manager) Reconfigure(apply func() error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := apply(); err != nil {
+		return err
+	}
+	m.staleness = time.Duration(common.RuleStaleness) * time.Second
+	m.expiry = time.Duration(common.RuleExpiryInterval) * time.Second
+	return nil
+}
+
+// Shutdown releases all floating IPs and waits until the leases are given
+// up and the addresses are removed.
+func (m *Manager) Shutdown() {
+	close(m.stop)
+	m.mutex.Lock()
+	for ip, c := range m.claims {
+		klog.Infof("releasing floating IP %s on shutdown\n", ip)
+		c.cancel()
+		delete(m.claims, ip)
+	}
+	m.mutex.Unlock()
+	m.elections.Wait()
+}
+
+func (m *Manager) elect(ctx context.Context, c *claim) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      leaseName(c.ip),
+			Namespace: m.namespace,
+		},
+		Client: m.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: m.identity,
+		},
+	}
+
+	// leadership might get lost (e.g. API server outage), so compete
+	// again until the claim is released
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   m.leaseDuration,
+			RenewDeadline:   m.renewDeadline,
+			RetryPeriod:     m.retryPeriod,
+			Name:            leaseName(c.ip),
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(leaderCtx context.Context) {
+					c.mutex.Lock()
+					defer c.mutex.Unlock()
+					// leadership already ended before the callback was scheduled
+					if leaderCtx.Err() != nil {
+						return
+					}
+					klog.Infof("acquired lease for floating IP %s, assigning address\n", c.ip)
+					if err := m.addresses.AddAddress(c.ip); err != nil {
+						klog.Errorf("could not assign floating IP %s: %v\n", c.ip, err)
+						return
+					}
+					if err := m.addresses.Announce(c.ip); err != nil {
+						klog.Warningf("could not announce floating IP %s: %v\n", c.ip, err)
+					}
+				},
+				OnStoppedLeading: func() {
+					c.mutex.Lock()
+					defer c.mutex.Unlock()
+					klog.Infof("lost lease for floating IP %s, removing address\n", c.ip)
+					if err := m.addresses.DeleteAddress(c.ip); err != nil {
+						klog.Errorf("could not remove floating IP %s: %v\n", c.ip, err)
+					}
+				},
+			},
+		})
+	}
+}
+
+func newManager(client kubernetes.Interface, addresses AddressHandler) *Manager {
+	return &Manager{
+		client:        client,
+		namespace:     common.GetEnv("NAMESPACE", "podnat-controller-system"),
+		identity:      common.NodeID,
+		addresses:     addresses,
+		claims:        make(map[string]*claim),
+		released:      make(map[string]*claim),
+		staleness:     time.Duration(common.RuleStaleness) * time.Second,
+		expiry:        time.Duration(common.RuleExpiryInterval) * time.Second,
+		leaseDuration: 15 * time.Second,
+		renewDeadline: 10 * time.Second,
+		retryPeriod:   2 * time.Second,
+		stop:          make(chan struct{}),
+	}
+}
+
+func NewManager(client kubernetes.Interface, iface string) (*Manager, error) {
+	addresses, err := NewNetlinkAddressHandler(iface)
+	if err != nil {
+		return nil, err
+	}
+	m := newManager(client, addresses)
+	if err := m.releaseStale(); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not remove stale floating IPs: %v", err))
+	}
+	go m.expireClaims()
+	return m, nil
+}
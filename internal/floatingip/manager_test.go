@@ -0,0 +1,239 @@
+package floatingip
+
+import (
+	"context"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/firewall"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type addressMock struct {
+	assigned    map[string]bool
+	deleteDelay time.Duration
+	mutex       sync.Mutex
+}
+
+func (a *addressMock) AddAddress(ip net.IP) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.assigned[ip.String()] = true
+	return nil
+}
+
+func (a *addressMock) DeleteAddress(ip net.IP) error {
+	time.Sleep(a.deleteDelay)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.assigned, ip.String())
+	return nil
+}
+
+func (a *addressMock) Announce(ip net.IP) error { return nil }
+
+func (a *addressMock) Addresses() ([]net.IP, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var ips []net.IP
+	for ip := range a.assigned {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	return ips, nil
+}
+
+func (a *addressMock) isAssigned(ip string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.assigned[ip]
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf(`timeout waiting for %s`, what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newTestManager(client *fake.Clientset, node string) (*Manager, *addressMock) {
+	addresses := &addressMock{assigned: make(map[string]bool)}
+	m := newManager(client, addresses)
+	m.identity = node
+	m.leaseDuration = 2 * time.Second
+	m.renewDeadline = time.Second
+	m.retryPeriod = 100 * time.Millisecond
+	return m, addresses
+}
+
+func TestManagerClaimAndRelease(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	client := fake.NewSimpleClientset()
+	m, addresses := newTestManager(client, "node1")
+
+	m.Claim("192.0.2.10", "default/mail-1")
+	m.Claim("192.0.2.10", "default/mail-2")
+	waitFor(t, "floating IP assignment", func() bool { return addresses.isAssigned("192.0.2.10") })
+
+	lease, err := client.CoordinationV1().Leases(m.namespace).Get(context.TODO(), "podnat-fip-192-0-2-10", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *lease.Spec.HolderIdentity != "node1" {
+		t.Fatalf(`lease holder = %s, want node1`, *lease.Spec.HolderIdentity)
+	}
+
+	// address stays as long as one local owner is left
+	m.Release("192.0.2.10", "default/mail-1")
+	time.Sleep(200 * time.Millisecond)
+	if !addresses.isAssigned("192.0.2.10") {
+		t.Fatal(`floating IP removed while still claimed`)
+	}
+
+	m.Release("192.0.2.10", "default/mail-2")
+	waitFor(t, "floating IP removal", func() bool { return !addresses.isAssigned("192.0.2.10") })
+}
+
+func TestManagerFailover(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	client := fake.NewSimpleClientset()
+	m1, addresses1 := newTestManager(client, "node1")
+	m2, addresses2 := newTestManager(client, "node2")
+
+	m1.Claim("192.0.2.20", "default/mail")
+	waitFor(t, "floating IP on node1", func() bool { return addresses1.isAssigned("192.0.2.20") })
+
+	// pod is rescheduled, new node claims before old node releases
+	m2.Claim("192.0.2.20", "default/mail")
+	time.Sleep(300 * time.Millisecond)
+	if addresses2.isAssigned("192.0.2.20") {
+		t.Fatal(`floating IP assigned on two nodes`)
+	}
+
+	m1.Release("192.0.2.20", "default/mail")
+	waitFor(t, "floating IP removal on node1", func() bool { return !addresses1.isAssigned("192.0.2.20") })
+	waitFor(t, "floating IP on node2", func() bool { return addresses2.isAssigned("192.0.2.20") })
+
+	m2.Release("192.0.2.20", "default/mail")
+	waitFor(t, "floating IP removal on node2", func() bool { return !addresses2.isAssigned("192.0.2.20") })
+}
+
+func TestManagerShutdownReleasesAddresses(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	client := fake.NewSimpleClientset()
+	m, addresses := newTestManager(client, "node1")
+
+	m.Claim("192.0.2.30", "default/mail")
+	waitFor(t, "floating IP assignment", func() bool { return addresses.isAssigned("192.0.2.30") })
+
+	m.Shutdown()
+	if addresses.isAssigned("192.0.2.30") {
+		t.Fatal(`floating IP still assigned after shutdown`)
+	}
+}
+
+func lease(ip, holder string) *coordinationv1.Lease {
+	duration := int32(15)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: leaseName(net.ParseIP(ip)), Namespace: "podnat-controller-system"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &metav1.MicroTime{Time: time.Now()},
+		},
+	}
+}
+
+func TestManagerReleasesStaleAddresses(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	client := fake.NewSimpleClientset(lease("192.0.2.50", "node2"), lease("192.0.2.51", "node1"))
+	m, addresses := newTestManager(client, "node1")
+	// left by a previous run next to the node address
+	for _, ip := range []string{"192.0.2.1", "192.0.2.50", "192.0.2.51"} {
+		addresses.assigned[ip] = true
+	}
+
+	if err := m.releaseStale(); err != nil {
+		t.Fatal(err)
+	}
+	if addresses.isAssigned("192.0.2.50") {
+		t.Fatal(`floating IP of a lease held by another node still assigned`)
+	}
+	if !addresses.isAssigned("192.0.2.1") || !addresses.isAssigned("192.0.2.51") {
+		t.Fatal(`node address or floating IP of a lease held by this node removed`)
+	}
+	m.mutex.Lock()
+	_, claimed := m.claims["192.0.2.51"]
+	m.mutex.Unlock()
+	if !claimed {
+		t.Fatal(`lease held by this node not claimed again`)
+	}
+	m.Shutdown()
+	if addresses.isAssigned("192.0.2.51") {
+		t.Fatal(`floating IP still assigned after shutdown`)
+	}
+}
+
+func TestManagerReclaimAfterRelease(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	client := fake.NewSimpleClientset()
+	m, addresses := newTestManager(client, "node1")
+
+	m.Claim("192.0.2.40", "default/mail-1")
+	waitFor(t, "floating IP assignment", func() bool { return addresses.isAssigned("192.0.2.40") })
+	addresses.deleteDelay = 200 * time.Millisecond
+
+	// e.g. the pod is recreated on the same node, the removal of the address
+	// by the old election must not follow the assignment of the new one
+	m.Release("192.0.2.40", "default/mail-1")
+	m.Claim("192.0.2.40", "default/mail-2")
+	waitFor(t, "floating IP assignment", func() bool { return addresses.isAssigned("192.0.2.40") })
+	time.Sleep(500 * time.Millisecond)
+	if !addresses.isAssigned("192.0.2.40") {
+		t.Fatal(`floating IP removed by released claim`)
+	}
+	m.Shutdown()
+}
+
+func TestProcessorKeepsSharedFloatingIP(t *testing.T) {
+	common.ResourcePrefix = "podnat"
+	client := fake.NewSimpleClientset()
+	m, addresses := newTestManager(client, "node1")
+	p := NewProcessor(firewall.NewDummyProcessor(), m)
+	ip := "192.0.2.50"
+	event := func(name string, ports ...uint16) *api.PodInfo {
+		var entries []api.NATDefinition
+		for _, port := range ports {
+			entries = append(entries, api.NATDefinition{SourceIP: &ip, SourcePort: port, Protocol: "tcp", Floating: true})
+		}
+		return &api.PodInfo{Event: name, Name: "web", Namespace: "default", Annotation: &api.PodNATAnnotation{TableEntries: entries}}
+	}
+
+	if err := p.Apply(event("add", 80, 443)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "floating IP assignment", func() bool { return addresses.isAssigned(ip) })
+
+	// the entry for port 80 is removed, 443 still needs the address
+	if err := p.Apply(event("delete", 80)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if !addresses.isAssigned(ip) {
+		t.Fatal(`floating IP removed while another entry uses it`)
+	}
+
+	if err := p.Apply(event("delete", 443)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "floating IP removal", func() bool { return !addresses.isAssigned(ip) })
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package floatingip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const garpCount = 3
+
+type NetlinkAddressHandler struct {
+	link netlink.Link
+}
+
+func (h *NetlinkAddressHandler) address(ip net.IP) *netlink.Addr {
+	return &netlink.Addr{IPNet: &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}}
+}
+
+func (h *NetlinkAddressHandler) AddAddress(ip net.IP) error {
+	return netlink.AddrReplace(h.link, h.address(ip))
+}
+
+func (h *NetlinkAddressHandler) DeleteAddress(ip net.IP) error {
+	err := netlink.AddrDel(h.link, h.address(ip))
+	// address not assigned, e.g. lease was never acquired
+	if errors.Is(err, unix.EADDRNOTAVAIL) {
+		return nil
+	}
+	return err
+}
+
+func (h *NetlinkAddressHandler) Addresses() ([]net.IP, error) {
+	addrs, err := netlink.AddrList(h.link, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+func htons(v uint16) uint16 {
+	return (v << 8) | (v >> 8)
+}
+
+// Announce sends gratuitous ARP requests, so neighbours and upstream
+// switches update their caches to the MAC address of this node.
+func (h *NetlinkAddressHandler) Announce(ip net.IP) error {
+	attrs := h.link.Attrs()
+	if len(attrs.HardwareAddr) != 6 {
+		return errors.New(fmt.Sprintf("interface %s has no ethernet address", attrs.Name))
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	addr := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  attrs.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], broadcast)
+
+	// ethernet header (14 bytes) and ARP request (28 bytes) with
+	// sender and target protocol address set to the floating IP
+	packet := make([]byte, 42)
+	copy(packet[0:6], broadcast)
+	copy(packet[6:12], attrs.HardwareAddr)
+	binary.BigEndian.PutUint16(packet[12:14], unix.ETH_P_ARP)
+	binary.BigEndian.PutUint16(packet[14:16], 1)
+	binary.BigEndian.PutUint16(packet[16:18], unix.ETH_P_IP)
+	packet[18] = 6
+	packet[19] = 4
+	binary.BigEndian.PutUint16(packet[20:22], 1)
+	copy(packet[22:28], attrs.HardwareAddr)
+	copy(packet[28:32], ip.To4())
+	copy(packet[38:42], ip.To4())
+
+	for i := 0; i < garpCount; i++ {
+		if i > 0 {
+			time.Sleep(time.Second)
+		}
+		if err = unix.Sendto(fd, packet, 0, addr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewNetlinkAddressHandler(iface string) (*NetlinkAddressHandler, error) {
+	var err error
+	if iface == "" {
+		// without explicit interface use the one holding the public node IP
+		if iface, err = common.PublicInterface(); err != nil {
+			return nil, errors.New(fmt.Sprintf("floating IP interface: %v", err))
+		}
+	}
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not find floating IP interface %s: %v", iface, err))
+	}
+	return &NetlinkAddressHandler{link: link}, nil
+}
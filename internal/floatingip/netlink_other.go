@@ -0,0 +1,19 @@
+//go:build !linux
+
+package floatingip
+
+import (
+	"errors"
+	"net"
+)
+
+type NetlinkAddressHandler struct{}
+
+func (h *NetlinkAddressHandler) AddAddress(ip net.IP) error    { return errors.ErrUnsupported }
+func (h *NetlinkAddressHandler) DeleteAddress(ip net.IP) error { return errors.ErrUnsupported }
+func (h *NetlinkAddressHandler) Announce(ip net.IP) error      { return errors.ErrUnsupported }
+func (h *NetlinkAddressHandler) Addresses() ([]net.IP, error)  { return nil, errors.ErrUnsupported }
+
+func NewNetlinkAddressHandler(iface string) (*NetlinkAddressHandler, error) {
+	return nil, errors.New("floating IPs are only supported on linux")
+}
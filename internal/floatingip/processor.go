@@ -0,0 +1,45 @@
+package floatingip
+
+import (
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"github.com/gutmensch/podnat-controller/internal/firewall"
+
+	"k8s.io/klog/v2"
+)
+
+// Processor claims floating IPs of annotation entries before handing the
+// event to the wrapped firewall processor for the NAT rules.
+type Processor struct {
+	next    firewall.Processor
+	manager *Manager
+}
+
+func (p *Processor) Apply(event *api.PodInfo) error {
+	for _, entry := range event.Annotation.TableEntries {
+		if !entry.Floating || entry.SourceIP == nil {
+			continue
+		}
+		// entries of a pod may share the floating IP, so each of them owns it
+		owner := fmt.Sprintf("%s/%s:%d/%s", event.Namespace, event.Name, entry.SourcePort, entry.Protocol)
+		if common.DryRun {
+			klog.Infof("dry-run activated, not changing floating IP %s for %s\n", *entry.SourceIP, owner)
+			continue
+		}
+		switch event.Event {
+		case "delete":
+			p.manager.Release(*entry.SourceIP, owner)
+		default:
+			p.manager.Claim(*entry.SourceIP, owner)
+		}
+	}
+	return p.next.Apply(event)
+}
+
+func NewProcessor(next firewall.Processor, manager *Manager) *Processor {
+	return &Processor{
+		next:    next,
+		manager: manager,
+	}
+}
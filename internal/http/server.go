@@ -1,16 +1,20 @@
 package http
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/gutmensch/podnat-controller/internal/common"
 	"net/http"
+	"reflect"
 
 	"k8s.io/klog/v2"
 )
 
 type HttpServer struct {
-	port int
-	mux  *http.ServeMux
+	port   int
+	mux    *http.ServeMux
+	server *http.Server
 }
 
 func liveness(w http.ResponseWriter, req *http.Request) {
@@ -30,9 +34,37 @@ func NewHTTPServer() *HttpServer {
 	server.mux.HandleFunc("/ping", liveness)
 	server.mux.HandleFunc("/ready", liveness)
 	server.mux.HandleFunc("/entries/list", generateNatEntryList)
+	server.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", server.port),
+		Handler: server.mux,
+	}
 	return server
 }
 
+// AddJSONHandler serves the current result of fn encoded as JSON, nil
+// results are answered with not found.
+func (s *HttpServer) AddJSONHandler(pattern string, fn func() interface{}) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+		data := fn()
+		// typed nil pointers, e.g. no plan yet
+		if v := reflect.ValueOf(data); data == nil || v.Kind() == reflect.Pointer && v.IsNil() {
+			http.Error(w, "no data available\n", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			klog.Warningf("could not encode response for %s: %v\n", pattern, err)
+		}
+	})
+}
+
 func (s *HttpServer) Run() {
-	klog.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", s.port), s.mux))
+	if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
+		klog.Fatalln(err)
+	}
+}
+
+// Shutdown stops accepting connections and waits for active requests.
+func (s *HttpServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
 }
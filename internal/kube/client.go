@@ -0,0 +1,62 @@
+package kube
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Clients share one rest config, so informers, state and floating IP
+// leases use the same rate limits and user agent
+type Clients struct {
+	Config     *rest.Config
+	Kubernetes kubernetes.Interface
+	Dynamic    dynamic.Interface
+}
+
+// restConfig reads the kubeconfig file if given, otherwise the in-cluster
+// service account config
+func restConfig(kubeConfig string) (*rest.Config, error) {
+	if kubeConfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", kubeConfig)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not load kubeconfig %s: %v", kubeConfig, err))
+		}
+		return config, nil
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("no kubeconfig given and not running in cluster: %v", err))
+	}
+	return config, nil
+}
+
+func NewClients(kubeConfig string) (*Clients, error) {
+	config, err := restConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	config.QPS = common.KubeQPS
+	config.Burst = common.KubeBurst
+	// the node in the user agent tells the controller pods apart in audit logs
+	config.UserAgent = fmt.Sprintf("podnat-controller/%s", common.NodeID)
+
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not create kubernetes client: %v", err))
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not create dynamic client: %v", err))
+	}
+	return &Clients{
+		Config:     config,
+		Kubernetes: clientSet,
+		Dynamic:    dynamicClient,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewClientsFromKubeconfig(t *testing.T) {
+	common.NodeID = "node1"
+	common.KubeQPS = 5
+	common.KubeBurst = 10
+	userAgent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case userAgent <- r.UserAgent():
+		default:
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"kind":"Node","apiVersion":"v1","metadata":{"name":"node1"}}`)
+	}))
+	defer server.Close()
+
+	kubeConfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(kubeConfig, []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`, server.URL)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clients, err := NewClients(kubeConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clients.Config.QPS != 5 || clients.Config.Burst != 10 {
+		t.Fatalf(`QPS/burst = %v/%d, want 5/10`, clients.Config.QPS, clients.Config.Burst)
+	}
+	if _, err := clients.Kubernetes.CoreV1().Nodes().Get(context.TODO(), "node1", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ua := <-userAgent; ua != "podnat-controller/node1" {
+		t.Fatalf(`user agent = %s, want podnat-controller/node1`, ua)
+	}
+}
+
+func TestNewClientsErrors(t *testing.T) {
+	if _, err := NewClients(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatalf(`NewClients() with missing kubeconfig succeeded`)
+	}
+	// outside of a pod there is no service account
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	if _, err := NewClients(""); err == nil {
+		t.Fatalf(`NewClients() without kubeconfig outside the cluster succeeded`)
+	}
+}
@@ -0,0 +1,178 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	serviceRangeArg = "--service-cluster-ip-range="
+	discoveryRetry  = 30 * time.Second
+)
+
+// appendUnique appends the networks not in list yet
+func appendUnique(list []string, networks ...string) []string {
+	for _, n := range networks {
+		if n != "" && !slices.Contains(list, n) {
+			list = append(list, n)
+		}
+	}
+	return list
+}
+
+// podNetworks returns the pod CIDRs of the nodes
+func podNetworks(nodes []*corev1.Node) []string {
+	var networks []string
+	for _, node := range nodes {
+		networks = appendUnique(networks, node.Spec.PodCIDRs...)
+		networks = appendUnique(networks, node.Spec.PodCIDR)
+	}
+	return networks
+}
+
+// serviceNetworks returns the service CIDR, it is not exposed by the API
+// and read from the arguments of kube-apiserver pods (e.g. kubeadm static
+// pods) if visible
+func serviceNetworks(client kubernetes.Interface) ([]string, error) {
+	pods, err := client.CoreV1().Pods("kube-system").List(context.TODO(), metav1.ListOptions{LabelSelector: "component=kube-apiserver"})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not list kube-apiserver pods: %v", err))
+	}
+	var networks []string
+	found := false
+	for _, pod := range pods.Items {
+		for _, container := range pod.Spec.Containers {
+			for _, arg := range append(container.Command, container.Args...) {
+				if !strings.HasPrefix(arg, serviceRangeArg) {
+					continue
+				}
+				found = true
+				networks = appendUnique(networks, strings.Split(strings.TrimPrefix(arg, serviceRangeArg), ",")...)
+			}
+		}
+	}
+	if !found {
+		klog.Warningf("service CIDR not found in kube-apiserver pods, add it to the internal networks\n")
+	}
+	return networks, nil
+}
+
+// DiscoverInternalNetworks returns the pod CIDRs of all nodes and the
+// service CIDR.
+func DiscoverInternalNetworks(client kubernetes.Interface) ([]string, error) {
+	nodes, err := client.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not list node pod CIDRs: %v", err))
+	}
+	var list []*corev1.Node
+	for i := range nodes.Items {
+		list = append(list, &nodes.Items[i])
+	}
+	services, err := serviceNetworks(client)
+	if err != nil {
+		return nil, err
+	}
+	return appendUnique(podNetworks(list), services...), nil
+}
+
+// podCIDRsOnly drops everything but the pod CIDRs from cached nodes, node
+// objects are large and updated often
+func podCIDRsOnly(obj interface{}) (interface{}, error) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return obj, nil
+	}
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: node.Name, ResourceVersion: node.ResourceVersion},
+		Spec:       corev1.NodeSpec{PodCIDR: node.Spec.PodCIDR, PodCIDRs: node.Spec.PodCIDRs},
+	}, nil
+}
+
+// WatchInternalNetworks keeps the pod CIDRs of the discovered networks up
+// to date with a node informer, e.g. of joined nodes, and applies changes
+// with reconfigure, so they are written while the processor holds its lock.
+// Updates of nodes are ignored unless their pod CIDRs change, the service
+// CIDR is read once.
+func WatchInternalNetworks(ctx context.Context, client kubernetes.Interface, reconfigure func(apply func() error) error) {
+	var services []string
+	for {
+		var err error
+		if services, err = serviceNetworks(client); err == nil {
+			break
+		}
+		klog.Warningf("discovering internal networks failed: %v\n", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discoveryRetry):
+		}
+	}
+
+	factory := kubeinformers.NewSharedInformerFactory(client, 0)
+	nodes := factory.Core().V1().Nodes()
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	_ = nodes.Informer().SetTransform(podCIDRsOnly)
+	_, _ = nodes.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { notify() },
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			o, n := oldObj.(*corev1.Node), newObj.(*corev1.Node)
+			if o.Spec.PodCIDR != n.Spec.PodCIDR || !slices.Equal(o.Spec.PodCIDRs, n.Spec.PodCIDRs) {
+				notify()
+			}
+		},
+		DeleteFunc: func(obj interface{}) { notify() },
+	})
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	current := slices.Clone(common.DiscoveredNetworks)
+	slices.Sort(current)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+		list, err := nodes.Lister().List(labels.Everything())
+		if err != nil {
+			klog.Warningf("discovering internal networks failed: %v\n", err)
+			continue
+		}
+		networks := appendUnique(podNetworks(list), services...)
+		slices.Sort(networks)
+		if slices.Equal(networks, current) {
+			continue
+		}
+		klog.Infof("discovered changed internal networks %v\n", networks)
+		err = reconfigure(func() error {
+			common.DiscoveredNetworks = networks
+			return nil
+		})
+		if err != nil {
+			klog.Warningf("applying discovered internal networks failed: %v\n", err)
+			continue
+		}
+		current = networks
+	}
+}
@@ -0,0 +1,90 @@
+package kube
+
+import (
+	"context"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDiscoverInternalNetworks(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			Spec:       corev1.NodeSpec{PodCIDR: "100.64.0.0/24", PodCIDRs: []string{"100.64.0.0/24", "fd00:10::/64"}},
+		},
+		&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+			Spec:       corev1.NodeSpec{PodCIDR: "100.64.1.0/24", PodCIDRs: []string{"100.64.1.0/24"}},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "kube-apiserver-node1", Namespace: "kube-system", Labels: map[string]string{"component": "kube-apiserver"}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{
+				Name:    "kube-apiserver",
+				Command: []string{"kube-apiserver", "--secure-port=6443", "--service-cluster-ip-range=10.96.0.0/12,fd00:20::/108"},
+			}}},
+		},
+	)
+
+	networks, err := DiscoverInternalNetworks(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"100.64.0.0/24", "fd00:10::/64", "100.64.1.0/24", "10.96.0.0/12", "fd00:20::/108"}
+	if !reflect.DeepEqual(networks, expected) {
+		t.Fatalf(`networks = %v, want %v`, networks, expected)
+	}
+}
+
+func TestWatchInternalNetworks(t *testing.T) {
+	common.DiscoveredNetworks = []string{"100.64.0.0/24"}
+	client := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       corev1.NodeSpec{PodCIDR: "100.64.0.0/24"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan []string, 1)
+	go WatchInternalNetworks(ctx, client, func(apply func() error) error {
+		err := apply()
+		applied <- common.DiscoveredNetworks
+		return err
+	})
+	expectApplied := func(expected []string) {
+		t.Helper()
+		select {
+		case networks := <-applied:
+			if !reflect.DeepEqual(networks, expected) {
+				t.Fatalf(`discovered networks = %v, want %v`, networks, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(`changed networks were not applied`)
+		}
+	}
+
+	// a joined node adds its pod CIDR
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+		Spec:       corev1.NodeSpec{PodCIDR: "100.64.1.0/24"},
+	}
+	if _, err := client.CoreV1().Nodes().Create(context.TODO(), node, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied([]string{"100.64.0.0/24", "100.64.1.0/24"})
+
+	// other node changes are ignored, the removal is the next applied change
+	node.Labels = map[string]string{"zone": "edge"}
+	if _, err := client.CoreV1().Nodes().Update(context.TODO(), node, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CoreV1().Nodes().Delete(context.TODO(), "node2", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectApplied([]string{"100.64.0.0/24"})
+}
@@ -0,0 +1,86 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"time"
+)
+
+// migrations convert the raw state of a version to the next version
+var migrations = map[int]func(data []byte) ([]byte, error){
+	1: migrateV1,
+}
+
+// version 1 stored the bare rules map without envelope
+func migrateV1(data []byte) ([]byte, error) {
+	s := NewState()
+	if err := json.Unmarshal(data, &s.Rules); err != nil {
+		return nil, err
+	}
+	if s.Rules == nil {
+		s.Rules = make(map[string][]*api.NATRule)
+	}
+	return json.Marshal(s)
+}
+
+func stateVersion(data []byte) (int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return 0, err
+	}
+	// rule keys are ip:port, so version is never a rule key
+	raw, ok := fields["version"]
+	if !ok {
+		return 1, nil
+	}
+	var version int
+	if err := json.Unmarshal(raw, &version); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Decode parses a stored state of any known version.
+func Decode(data []byte) (*State, error) {
+	version, err := stateVersion(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("state format malformed: %v", err))
+	}
+	if version > Version {
+		return nil, errors.New(fmt.Sprintf("state version %d is newer than supported version %d", version, Version))
+	}
+	for ; version < Version; version++ {
+		migrate, ok := migrations[version]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("no migration for state version %d", version))
+		}
+		if data, err = migrate(data); err != nil {
+			return nil, errors.New(fmt.Sprintf("migrating state version %d failed: %v", version, err))
+		}
+	}
+
+	s := &State{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, errors.New(fmt.Sprintf("state format malformed: %v", err))
+	}
+	if s.Rules == nil {
+		s.Rules = make(map[string][]*api.NATRule)
+	}
+	return s, nil
+}
+
+func encode(s *State) ([]byte, error) {
+	s.Version = Version
+	if s.NodeID == "" {
+		s.NodeID = common.NodeID
+	}
+	s.UpdatedAt = time.Now()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not encode data to json: %v", err))
+	}
+	return data, nil
+}
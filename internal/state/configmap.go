@@ -2,107 +2,115 @@ package state
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gutmensch/podnat-controller/internal/common"
 	corev1 "k8s.io/api/core/v1"
-	"os"
 	"sync"
 
 	k8serr "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
 
 type ConfigMapState struct {
-	Client    *kubernetes.Clientset
+	Client    kubernetes.Interface
 	Name      string
 	Namespace string
+	Owner     *metav1.OwnerReference
 	Mutex     sync.Mutex
 }
 
-func (s *ConfigMapState) Put(data interface{}) error {
+// Save uses the resourceVersion of the loaded configmap, so the API server
+// refuses updates based on an outdated state
+func (s *ConfigMapState) Save(state *State) error {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	var err error
-	var jsonData []byte
-	jsonData, err = json.Marshal(data)
+	jsonData, err := encode(state)
 	if err != nil {
-		return errors.New(fmt.Sprintf("could not encode data to json: %v\n", err))
+		return err
 	}
 
 	configMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: s.Name,
+			Name:            s.Name,
+			ResourceVersion: state.Revision,
 		},
 		Data: map[string]string{
 			"state.json": string(jsonData),
 		},
 	}
 
-	if _, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Get(context.TODO(), s.Name, metav1.GetOptions{}); k8serr.IsNotFound(err) {
+	if s.Owner != nil {
+		configMap.OwnerReferences = []metav1.OwnerReference{*s.Owner}
+	}
+
+	if state.Revision == "" {
 		klog.V(9).Infof("creating configmap %s", s.Name)
-		_, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+		configMap, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
 	} else {
 		klog.V(9).Infof("updating existing configmap %s", s.Name)
-		_, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		configMap, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	}
+	if k8serr.IsAlreadyExists(err) || k8serr.IsConflict(err) || k8serr.IsNotFound(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
 	}
+	state.Revision = configMap.ResourceVersion
 
-	return err
+	return nil
 }
 
-func (s *ConfigMapState) Get() ([]byte, error) {
+func (s *ConfigMapState) Load() (*State, error) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	var configMap *corev1.ConfigMap
-	var err error
-	var exists bool
-
-	configMap, err = s.Client.CoreV1().ConfigMaps(s.Namespace).Get(context.TODO(), s.Name, metav1.GetOptions{})
 
+	configMap, err := s.Client.CoreV1().ConfigMaps(s.Namespace).Get(context.TODO(), s.Name, metav1.GetOptions{})
 	if k8serr.IsNotFound(err) {
-		klog.Warningf("configmap %s in namespace %s not found, error: '%v'\n", s.Name, s.Namespace, err)
-		goto ExitWithError
+		return nil, ErrNotFound
 	}
-
 	if statusError, isStatus := err.(*k8serr.StatusError); isStatus {
-		klog.Warningf("error getting configmap: %v\n", statusError.ErrStatus.Message)
-		goto ExitWithError
+		return nil, errors.New(fmt.Sprintf("error getting configmap: %v\n", statusError.ErrStatus.Message))
 	}
-
-	if _, exists = configMap.Data["state.json"]; exists {
-		return []byte(configMap.Data["state.json"]), nil
+	if err != nil {
+		return nil, err
 	}
 
-ExitWithError:
-	return []byte(""), err
-}
-
-func NewConfigMapState() *ConfigMapState {
-	kubeConfig := common.GetEnv("KUBECONFIG", "")
-	var config *rest.Config
-	var clientSet *kubernetes.Clientset
-	var err error
-	config, err = clientcmd.BuildConfigFromFlags("", kubeConfig)
+	// configmap without state, e.g. created manually
+	data, exists := configMap.Data["state.json"]
+	if !exists || data == "" {
+		state := NewState()
+		state.Revision = configMap.ResourceVersion
+		return state, nil
+	}
+	state, err := Decode([]byte(data))
 	if err != nil {
-		klog.Errorln(err)
-		os.Exit(1)
+		return nil, err
 	}
+	state.Revision = configMap.ResourceVersion
+	return state, nil
+}
 
-	clientSet, err = kubernetes.NewForConfig(config)
-	if err != nil {
-		klog.Errorln(err)
-		os.Exit(1)
+func (s *ConfigMapState) Delete() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	err := s.Client.CoreV1().ConfigMaps(s.Namespace).Delete(context.TODO(), s.Name, metav1.DeleteOptions{})
+	if k8serr.IsNotFound(err) {
+		return nil
 	}
+	return err
+}
 
+func NewConfigMapState(clientSet kubernetes.Interface) *ConfigMapState {
+	// owned by the node, so the configmap is removed with the node
 	state := &ConfigMapState{
 		Client:    clientSet,
 		Name:      fmt.Sprintf("podnat-controller-%s", common.NodeID),
 		Namespace: common.GetEnv("NAMESPACE", "podnat-controller-system"),
+		Owner:     nodeOwner(clientSet, stateNodeName()),
 	}
 
 	return state
@@ -0,0 +1,90 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newVersionedClient returns a fake clientset which checks and bumps the
+// resourceVersion of configmaps like the API server
+func newVersionedClient() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	gvr := corev1.SchemeGroupVersion.WithResource("configmaps")
+	var version int
+	var mutex sync.Mutex
+
+	client.PrependReactor("create", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cm := action.(k8stesting.CreateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+		version++
+		cm.ResourceVersion = strconv.Itoa(version)
+		return true, cm, client.Tracker().Create(gvr, cm, action.GetNamespace())
+	})
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cm := action.(k8stesting.UpdateAction).GetObject().(*corev1.ConfigMap).DeepCopy()
+		current, err := client.Tracker().Get(gvr, action.GetNamespace(), cm.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		if current.(*corev1.ConfigMap).ResourceVersion != cm.ResourceVersion {
+			return true, nil, k8serr.NewConflict(gvr.GroupResource(), cm.Name, errors.New("resourceVersion mismatch"))
+		}
+		version++
+		cm.ResourceVersion = strconv.Itoa(version)
+		return true, cm, client.Tracker().Update(gvr, cm, action.GetNamespace())
+	})
+	return client
+}
+
+func TestConfigMapStateConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (StateStore, StateStore, func([]byte)) {
+		client := newVersionedClient()
+		a := &ConfigMapState{Client: client, Name: "podnat-controller-node1", Namespace: "podnat"}
+		b := &ConfigMapState{Client: client, Name: "podnat-controller-node1", Namespace: "podnat"}
+		return a, b, func(data []byte) {
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: a.Name},
+				Data:       map[string]string{"state.json": string(data)},
+			}
+			if _, err := client.CoreV1().ConfigMaps(a.Namespace).Create(context.TODO(), cm, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestConfigMapStateOwnedByNode(t *testing.T) {
+	client := newVersionedClient()
+	node, err := client.CoreV1().Nodes().Create(context.TODO(), &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", UID: "1234"}}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &ConfigMapState{Client: client, Name: "podnat-controller-node1", Namespace: "podnat", Owner: nodeOwner(client, node.Name)}
+	s := NewState()
+	for i := 0; i < 2; i++ {
+		if err := store.Save(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cm, err := client.CoreV1().ConfigMaps("podnat").Get(context.TODO(), store.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.OwnerReferences) != 1 || cm.OwnerReferences[0].UID != node.UID {
+		t.Fatalf(`owner references after update = %v, want node node1`, cm.OwnerReferences)
+	}
+}
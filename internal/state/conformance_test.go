@@ -0,0 +1,150 @@
+package state
+
+import (
+	"errors"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"testing"
+	"time"
+)
+
+// backend returns two stores for the same node state, e.g. controller and
+// state subcommand, and a function writing raw data to the store
+type backend func(t *testing.T) (StateStore, StateStore, func(data []byte))
+
+func testRule(port uint16) []*api.NATRule {
+	return []*api.NATRule{{
+		Protocol:        "tcp",
+		SourceIP:        common.ParseIP("1.2.3.4"),
+		SourcePort:      port,
+		DestinationIP:   common.ParseIP("10.0.0.5"),
+		DestinationPort: port,
+		Created:         time.Now(),
+		Comment:         "mail:mail",
+	}}
+}
+
+// runConformance checks the StateStore contract every backend must fulfill
+func runConformance(t *testing.T, newBackend backend) {
+	common.NodeID = "node1"
+
+	t.Run("LoadMissing", func(t *testing.T) {
+		a, _, _ := newBackend(t)
+		if _, err := a.Load(); !errors.Is(err, ErrNotFound) {
+			t.Fatalf(`Load() error = %v, want ErrNotFound`, err)
+		}
+	})
+
+	t.Run("SaveLoad", func(t *testing.T) {
+		a, b, _ := newBackend(t)
+		s := NewState()
+		s.Rules["1.2.3.4:25"] = testRule(25)
+		if err := a.Save(s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Revision == "" || s.UpdatedAt.IsZero() {
+			t.Fatalf(`Save() did not set revision and update time: %+v`, s)
+		}
+		loaded, err := b.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.Version != Version || loaded.NodeID != "node1" || loaded.Revision != s.Revision {
+			t.Fatalf(`loaded envelope = %+v, want version %d, node1 and revision %s`, loaded, Version, s.Revision)
+		}
+		if len(loaded.Rules["1.2.3.4:25"]) != 1 || loaded.Rules["1.2.3.4:25"][0].DestinationIP.String() != "10.0.0.5" {
+			t.Fatalf(`loaded rules = %v`, loaded.Rules)
+		}
+	})
+
+	t.Run("ConflictOnCreate", func(t *testing.T) {
+		a, b, _ := newBackend(t)
+		if err := a.Save(NewState()); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Save(NewState()); !errors.Is(err, ErrConflict) {
+			t.Fatalf(`Save() of second new state error = %v, want ErrConflict`, err)
+		}
+	})
+
+	t.Run("ConflictOnUpdate", func(t *testing.T) {
+		a, b, _ := newBackend(t)
+		if err := a.Save(NewState()); err != nil {
+			t.Fatal(err)
+		}
+		sa, err := a.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb, err := b.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sb.Rules["1.2.3.4:25"] = testRule(25)
+		if err := b.Save(sb); err != nil {
+			t.Fatal(err)
+		}
+		// a did not see the change of b
+		sa.Rules["1.2.3.4:143"] = testRule(143)
+		if err := a.Save(sa); !errors.Is(err, ErrConflict) {
+			t.Fatalf(`Save() with outdated revision error = %v, want ErrConflict`, err)
+		}
+
+		current, err := a.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := current.Rules["1.2.3.4:25"]; !ok {
+			t.Fatalf(`change of b was overwritten: %v`, current.Rules)
+		}
+		current.Rules["1.2.3.4:143"] = testRule(143)
+		if err := a.Save(current); err != nil {
+			t.Fatalf(`Save() after reload failed: %v`, err)
+		}
+		// consecutive saves use the revision of the previous save
+		if err := a.Save(current); err != nil {
+			t.Fatalf(`second Save() failed: %v`, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		a, b, _ := newBackend(t)
+		if err := a.Save(NewState()); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Load(); !errors.Is(err, ErrNotFound) {
+			t.Fatalf(`Load() after Delete() error = %v, want ErrNotFound`, err)
+		}
+		if err := b.Delete(); err != nil {
+			t.Fatalf(`Delete() of missing state failed: %v`, err)
+		}
+	})
+
+	t.Run("MigrateVersion1", func(t *testing.T) {
+		a, _, writeRaw := newBackend(t)
+		writeRaw([]byte(`{"1.2.3.4:25":[{"Protocol":"tcp","SourceIP":{"IP":"1.2.3.4","Zone":""},"SourcePort":25,` +
+			`"DestinationIP":{"IP":"10.0.0.5","Zone":""},"DestinationPort":25,"Comment":"mail:mail"}]}`))
+		s, err := a.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Version != Version || s.NodeID != "node1" || len(s.Rules["1.2.3.4:25"]) != 1 {
+			t.Fatalf(`migrated state = %+v`, s)
+		}
+		if err := a.Save(s); err != nil {
+			t.Fatalf(`Save() of migrated state failed: %v`, err)
+		}
+	})
+
+	t.Run("RejectNewerVersion", func(t *testing.T) {
+		a, _, writeRaw := newBackend(t)
+		writeRaw([]byte(`{"version":99,"rules":{}}`))
+		if _, err := a.Load(); err == nil {
+			t.Fatal(`expected error for unsupported state version`)
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package state
+
+import (
+	"context"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"sync"
+
+	"k8s.io/klog/v2"
+
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NodeStateResource is the cluster scoped PodNATNodeState custom resource,
+// one object named after the node holds its state
+var NodeStateResource = schema.GroupVersionResource{
+	Group:    "podnat.bln.space",
+	Version:  "v1alpha1",
+	Resource: "podnatnodestates",
+}
+
+// CRDState stores the state in a PodNATNodeState owned by the node object,
+// so the garbage collector removes it together with the node
+type CRDState struct {
+	Client dynamic.Interface
+	Name   string
+	Owner  *metav1.OwnerReference
+	Mutex  sync.Mutex
+}
+
+func (s *CRDState) Save(state *State) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	jsonData, err := encode(state)
+	if err != nil {
+		return err
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(NodeStateResource.GroupVersion().String())
+	obj.SetKind("PodNATNodeState")
+	obj.SetName(s.Name)
+	obj.SetResourceVersion(state.Revision)
+	if s.Owner != nil {
+		obj.SetOwnerReferences([]metav1.OwnerReference{*s.Owner})
+	}
+	if err := unstructured.SetNestedField(obj.Object, string(jsonData), "spec", "state"); err != nil {
+		return err
+	}
+
+	client := s.Client.Resource(NodeStateResource)
+	if state.Revision == "" {
+		klog.V(9).Infof("creating node state %s", s.Name)
+		obj, err = client.Create(context.TODO(), obj, metav1.CreateOptions{})
+	} else {
+		klog.V(9).Infof("updating existing node state %s", s.Name)
+		obj, err = client.Update(context.TODO(), obj, metav1.UpdateOptions{})
+	}
+	if k8serr.IsAlreadyExists(err) || k8serr.IsConflict(err) || k8serr.IsNotFound(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	state.Revision = obj.GetResourceVersion()
+	return nil
+}
+
+func (s *CRDState) Load() (*State, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	obj, err := s.Client.Resource(NodeStateResource).Get(context.TODO(), s.Name, metav1.GetOptions{})
+	if k8serr.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := unstructured.NestedString(obj.Object, "spec", "state")
+	if err != nil {
+		return nil, err
+	}
+	if data == "" {
+		state := NewState()
+		state.Revision = obj.GetResourceVersion()
+		return state, nil
+	}
+	state, err := Decode([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	state.Revision = obj.GetResourceVersion()
+	return state, nil
+}
+
+func (s *CRDState) Delete() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	err := s.Client.Resource(NodeStateResource).Delete(context.TODO(), s.Name, metav1.DeleteOptions{})
+	if k8serr.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// nodeOwner references the node object as owner of its state, without
+// the node (e.g. when running outside the cluster) the state is not owned
+func nodeOwner(client kubernetes.Interface, name string) *metav1.OwnerReference {
+	node, err := client.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		klog.Warningf("could not get node %s, state is not garbage collected with the node: %v\n", name, err)
+		return nil
+	}
+	return &metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Node",
+		Name:       node.Name,
+		UID:        node.UID,
+	}
+}
+
+// stateNodeName is the k8s node name, the node ID is the short host name
+func stateNodeName() string {
+	if common.NodeName != "" {
+		return common.NodeName
+	}
+	return common.NodeID
+}
+
+func NewCRDState(client dynamic.Interface, clientSet kubernetes.Interface) *CRDState {
+	return &CRDState{
+		Client: client,
+		Name:   common.NodeID,
+		Owner:  nodeOwner(clientSet, stateNodeName()),
+	}
+}
@@ -0,0 +1,99 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newVersionedDynamicClient returns a fake dynamic client which checks and
+// bumps the resourceVersion of node states like the API server
+func newVersionedDynamicClient() *dynamicfake.FakeDynamicClient {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{NodeStateResource: "PodNATNodeStateList"})
+	var version int
+	var mutex sync.Mutex
+
+	client.PrependReactor("create", NodeStateResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		obj := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		version++
+		obj.SetResourceVersion(strconv.Itoa(version))
+		return true, obj, client.Tracker().Create(NodeStateResource, obj, "")
+	})
+	client.PrependReactor("update", NodeStateResource.Resource, func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		obj := action.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured).DeepCopy()
+		current, err := client.Tracker().Get(NodeStateResource, "", obj.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		if current.(*unstructured.Unstructured).GetResourceVersion() != obj.GetResourceVersion() {
+			return true, nil, k8serr.NewConflict(NodeStateResource.GroupResource(), obj.GetName(), errors.New("resourceVersion mismatch"))
+		}
+		version++
+		obj.SetResourceVersion(strconv.Itoa(version))
+		return true, obj, client.Tracker().Update(NodeStateResource, obj, "")
+	})
+	return client
+}
+
+func TestCRDStateConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (StateStore, StateStore, func([]byte)) {
+		client := newVersionedDynamicClient()
+		a := &CRDState{Client: client, Name: "node1"}
+		b := &CRDState{Client: client, Name: "node1"}
+		return a, b, func(data []byte) {
+			obj := &unstructured.Unstructured{}
+			obj.SetAPIVersion(NodeStateResource.GroupVersion().String())
+			obj.SetKind("PodNATNodeState")
+			obj.SetName(a.Name)
+			if err := unstructured.SetNestedField(obj.Object, string(data), "spec", "state"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Resource(NodeStateResource).Create(context.TODO(), obj, metav1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCRDStateOwnedByNode(t *testing.T) {
+	nodes := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1.lan", UID: "1234"}})
+	client := newVersionedDynamicClient()
+	store := &CRDState{Client: client, Name: "node1", Owner: nodeOwner(nodes, "node1.lan")}
+
+	s := NewState()
+	for i := 0; i < 2; i++ {
+		if err := store.Save(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj, err := client.Resource(NodeStateResource).Get(context.TODO(), "node1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := obj.GetOwnerReferences()
+	if len(owners) != 1 || owners[0].Kind != "Node" || owners[0].Name != "node1.lan" || owners[0].UID != "1234" {
+		t.Fatalf(`owner references after update = %v, want node node1.lan`, owners)
+	}
+
+	if owner := nodeOwner(nodes, "missing"); owner != nil {
+		t.Fatalf(`nodeOwner() of missing node = %v, want nil`, owner)
+	}
+}
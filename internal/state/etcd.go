@@ -0,0 +1,153 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const etcdRequestTimeout = 10 * time.Second
+
+// EtcdState stores the state of a node in one key under a prefix. Writes
+// are compare-and-swap on the mod revision of the loaded state, so changes
+// by other writers are not overwritten silently.
+type EtcdState struct {
+	Client *clientv3.Client
+	Key    string
+	Mutex  sync.Mutex
+	// latest revision written or read, older changes are known
+	revision int64
+}
+
+func (s *EtcdState) Save(state *State) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	jsonData, err := encode(state)
+	if err != nil {
+		return err
+	}
+	revision := int64(0)
+	if state.Revision != "" {
+		if revision, err = strconv.ParseInt(state.Revision, 10, 64); err != nil {
+			return errors.New(fmt.Sprintf("invalid state revision %s\n", state.Revision))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+	resp, err := s.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(s.Key), "=", revision)).
+		Then(clientv3.OpPut(s.Key, string(jsonData))).
+		Commit()
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not write state: %v\n", err))
+	}
+	if !resp.Succeeded {
+		return ErrConflict
+	}
+	state.Revision = strconv.FormatInt(resp.Header.Revision, 10)
+	s.revision = resp.Header.Revision
+	return nil
+}
+
+func (s *EtcdState) Load() (*State, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+	resp, err := s.Client.Get(ctx, s.Key)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not read state: %v\n", err))
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNotFound
+	}
+	state, err := Decode(resp.Kvs[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	state.Revision = strconv.FormatInt(resp.Kvs[0].ModRevision, 10)
+	s.revision = resp.Kvs[0].ModRevision
+	return state, nil
+}
+
+func (s *EtcdState) Delete() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), etcdRequestTimeout)
+	defer cancel()
+	if _, err := s.Client.Delete(ctx, s.Key); err != nil {
+		return errors.New(fmt.Sprintf("could not delete state: %v\n", err))
+	}
+	return nil
+}
+
+// known reports if the change with revision was written or read by this store
+func (s *EtcdState) known(revision int64) bool {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return revision <= s.revision
+}
+
+// Watch returns the state on every change by others until ctx is done,
+// deletions are returned as nil. Changes written or already read by this
+// store (e.g. merged after a conflict) are skipped.
+func (s *EtcdState) Watch(ctx context.Context) <-chan *State {
+	changes := make(chan *State)
+	go func() {
+		defer close(changes)
+		for resp := range s.Client.Watch(ctx, s.Key) {
+			if err := resp.Err(); err != nil {
+				klog.Warningf("watching state %s failed: %v\n", s.Key, err)
+				continue
+			}
+			for _, event := range resp.Events {
+				var state *State
+				if event.Type == clientv3.EventTypePut {
+					if s.known(event.Kv.ModRevision) {
+						continue
+					}
+					var err error
+					if state, err = Decode(event.Kv.Value); err != nil {
+						klog.Warningf("ignoring malformed state change of %s: %v\n", s.Key, err)
+						continue
+					}
+					state.Revision = strconv.FormatInt(event.Kv.ModRevision, 10)
+				}
+				select {
+				case changes <- state:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes
+}
+
+func newEtcdState(client *clientv3.Client, prefix string) *EtcdState {
+	return &EtcdState{
+		Client: client,
+		Key:    fmt.Sprintf("%s/%s", strings.TrimSuffix(prefix, "/"), common.NodeID),
+	}
+}
+
+func NewEtcdState() (*EtcdState, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(common.EtcdEndpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not create etcd client: %v\n", err))
+	}
+	return newEtcdState(client, common.EtcdPrefix), nil
+}
@@ -0,0 +1,147 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func startEtcd(t *testing.T) *clientv3.Client {
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	peer, client := freeURL(t), freeURL(t)
+	cfg.ListenPeerUrls = []url.URL{peer}
+	cfg.AdvertisePeerUrls = []url.URL{peer}
+	cfg.ListenClientUrls = []url.URL{client}
+	cfg.AdvertiseClientUrls = []url.URL{client}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peer.String())
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal(`embedded etcd did not start`)
+	}
+
+	c, err := clientv3.New(clientv3.Config{Endpoints: []string{client.String()}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestEtcdStateConformance(t *testing.T) {
+	client := startEtcd(t)
+	runConformance(t, func(t *testing.T) (StateStore, StateStore, func([]byte)) {
+		// separate prefix per test, the server is shared
+		prefix := "/podnat/" + t.Name()
+		a := newEtcdState(client, prefix)
+		b := newEtcdState(client, prefix)
+		return a, b, func(data []byte) {
+			if _, err := client.Put(context.Background(), a.Key, string(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestEtcdStateKey(t *testing.T) {
+	common.NodeID = "node1"
+	s := newEtcdState(nil, "/podnat/state/")
+	if s.Key != "/podnat/state/node1" {
+		t.Fatalf(`key = %s, want /podnat/state/node1`, s.Key)
+	}
+}
+
+func TestEtcdStateWatch(t *testing.T) {
+	common.NodeID = "node1"
+	client := startEtcd(t)
+	s1 := newEtcdState(client, "/podnat/state")
+	s2 := newEtcdState(client, "/podnat/state")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := s1.Watch(ctx)
+	// give the watch time to register
+	time.Sleep(100 * time.Millisecond)
+
+	state := NewState()
+	state.Rules["1.2.3.4:25"] = testRule(25)
+	if err := s2.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, deleted := range []bool{false, true} {
+		select {
+		case change := <-changes:
+			if deleted && change != nil {
+				t.Fatalf(`deletion delivered as %+v, want nil`, change)
+			}
+			if !deleted && (change == nil || change.Revision != state.Revision || len(change.Rules) != 1) {
+				t.Fatalf(`watched state = %+v, want revision %s with one rule`, change, state.Revision)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal(`no change delivered by watch`)
+		}
+	}
+}
+
+func TestEtcdStateWatchSkipsKnownChanges(t *testing.T) {
+	common.NodeID = "node1"
+	client := startEtcd(t)
+	s1 := newEtcdState(client, "/podnat/state")
+	s2 := newEtcdState(client, "/podnat/state")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := s1.Watch(ctx)
+	time.Sleep(100 * time.Millisecond)
+
+	own := NewState()
+	own.Rules["1.2.3.4:25"] = testRule(25)
+	if err := s1.Save(own); err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := s2.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs.Rules["1.2.3.4:26"] = testRule(26)
+	if err := s2.Save(theirs); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case change := <-changes:
+		if change == nil || change.Revision != theirs.Revision {
+			t.Fatalf(`watched state = %+v, want revision %s of the other writer`, change, theirs.Revision)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal(`no change delivered by watch`)
+	}
+}
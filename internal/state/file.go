@@ -0,0 +1,136 @@
+package state
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileState keeps the state in a local directory, e.g. a hostPath volume,
+// which survives pod restarts on the same node.
+type FileState struct {
+	Directory string
+	File      string
+	Mutex     sync.Mutex
+}
+
+func (s *FileState) path() string {
+	return filepath.Join(s.Directory, s.File)
+}
+
+// revision of the state file is the hash of its content
+func fileRevision(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func (s *FileState) currentRevision() (string, error) {
+	data, err := os.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return fileRevision(data), nil
+}
+
+// Save replaces the state file atomically, readers see either the old or
+// the new state, also after a crash. The revision check protects against
+// other writers on the node like the state subcommand.
+func (s *FileState) Save(state *State) error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	jsonData, err := encode(state)
+	if err != nil {
+		return err
+	}
+
+	current, err := s.currentRevision()
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not read state: %v\n", err))
+	}
+	if current != state.Revision {
+		return ErrConflict
+	}
+
+	tmp, err := os.CreateTemp(s.Directory, fmt.Sprintf(".%s-*", s.File))
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not create temporary state file: %v\n", err))
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(jsonData); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not write temporary state file: %v\n", err))
+	}
+	if err = os.Rename(tmp.Name(), s.path()); err != nil {
+		return errors.New(fmt.Sprintf("could not replace state file: %v\n", err))
+	}
+	if err = s.syncDirectory(); err != nil {
+		return err
+	}
+	state.Revision = fileRevision(jsonData)
+	return nil
+}
+
+// syncDirectory persists the rename
+func (s *FileState) syncDirectory() error {
+	dir, err := os.Open(s.Directory)
+	if err != nil {
+		return errors.New(fmt.Sprintf("could not open state directory: %v\n", err))
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil {
+		return errors.New(fmt.Sprintf("could not sync state directory: %v\n", err))
+	}
+	return nil
+}
+
+func (s *FileState) Load() (*State, error) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	bytes, err := os.ReadFile(s.path())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not read state: %v\n", err))
+	}
+	state, err := Decode(bytes)
+	if err != nil {
+		return nil, err
+	}
+	state.Revision = fileRevision(bytes)
+	return state, nil
+}
+
+func (s *FileState) Delete() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if err := os.Remove(s.path()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New(fmt.Sprintf("could not delete state: %v\n", err))
+	}
+	return nil
+}
+
+func newFileState(directory string) (*FileState, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, errors.New(fmt.Sprintf("could not create state directory: %v\n", err))
+	}
+	return &FileState{
+		Directory: directory,
+		File:      "state.json",
+	}, nil
+}
+
+func NewFileState() (*FileState, error) {
+	return newFileState(common.StateDirectory)
+}
@@ -0,0 +1,40 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStateConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (StateStore, StateStore, func([]byte)) {
+		dir := filepath.Join(t.TempDir(), "podnat")
+		a, err := newFileState(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := newFileState(dir)
+		return a, b, func(data []byte) {
+			if err := os.WriteFile(a.path(), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestFileStateLeavesNoTemporaryFiles(t *testing.T) {
+	s, err := newFileState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := NewState()
+	for i := 0; i < 2; i++ {
+		if err := s.Save(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, _ := os.ReadDir(s.Directory)
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		t.Fatalf(`unexpected files in state directory: %v`, entries)
+	}
+}
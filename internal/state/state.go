@@ -1,6 +1,45 @@
 package state
 
+import (
+	"errors"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"time"
+)
+
+// Version of the state envelope, states of older versions are migrated
+// when loaded
+const Version = 2
+
+var (
+	ErrNotFound = errors.New("state not found")
+	ErrConflict = errors.New("state changed concurrently")
+)
+
+// State is the envelope stored per node. Revision is set by the store on
+// load and save and is used for optimistic concurrency (resourceVersion,
+// ETag, etcd revision).
+type State struct {
+	Version   int                       `json:"version"`
+	NodeID    string                    `json:"nodeID"`
+	UpdatedAt time.Time                 `json:"updatedAt"`
+	Rules     map[string][]*api.NATRule `json:"rules"`
+	Revision  string                    `json:"-"`
+}
+
 type StateStore interface {
-	Get() ([]byte, error)
-	Put(data interface{}) error
+	// Load returns ErrNotFound if no state was saved for the node yet
+	Load() (*State, error)
+	// Save writes s if the stored state was not changed since s was loaded
+	// or saved, otherwise ErrConflict is returned
+	Save(s *State) error
+	Delete() error
+}
+
+func NewState() *State {
+	return &State{
+		Version: Version,
+		NodeID:  common.NodeID,
+		Rules:   make(map[string][]*api.NATRule),
+	}
 }
@@ -1,13 +1,17 @@
 package state
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/gutmensch/podnat-controller/internal/common"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/studio-b12/gowebdav"
 	"k8s.io/klog/v2"
@@ -15,51 +19,256 @@ import (
 
 type WebDAVState struct {
 	Client    *gowebdav.Client
+	ETags     *etagTransport
 	Directory string
 	File      string
+	Retries   int
 	Mutex     sync.Mutex
 }
 
-func (s *WebDAVState) Put(data interface{}) error {
+// WebDAVConfig describes the connection to the WebDAV server. SecretDir is
+// a mounted Secret with the keys username and password for basic auth or
+// token for bearer auth, a ca.crt key is used if CAFile is empty.
+type WebDAVConfig struct {
+	URI       string
+	SecretDir string
+	CAFile    string
+	Timeout   time.Duration
+	Retries   int
+}
+
+func readSecret(dir, key string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// etagTransport remembers the ETag of the last PUT response, a separate
+// request after the write could return the ETag of a write by others
+type etagTransport struct {
+	next http.RoundTripper
+	etag string
+}
+
+func (t *etagTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	rs, err := t.next.RoundTrip(rq)
+	if err == nil && rq.Method == "PUT" {
+		t.etag = rs.Header.Get("ETag")
+	}
+	return rs, err
+}
+
+func newWebDAVClient(config WebDAVConfig) (*gowebdav.Client, *etagTransport, error) {
+	var username, password, token string
+	if config.SecretDir != "" {
+		for key, value := range map[string]*string{"username": &username, "password": &password, "token": &token} {
+			var err error
+			if *value, err = readSecret(config.SecretDir, key); err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("could not read webdav secret %s: %v\n", key, err))
+			}
+		}
+		if token != "" && username != "" {
+			return nil, nil, errors.New("webdav secret must contain either username and password or token\n")
+		}
+	}
+	client := gowebdav.NewClient(config.URI, username, password)
+	if token != "" {
+		client.SetHeader("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	if config.Timeout > 0 {
+		client.SetTimeout(config.Timeout)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	caFile := config.CAFile
+	if caFile == "" && config.SecretDir != "" {
+		if _, err := os.Stat(filepath.Join(config.SecretDir, "ca.crt")); err == nil {
+			caFile = filepath.Join(config.SecretDir, "ca.crt")
+		}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("could not read webdav CA %s: %v\n", caFile, err))
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, errors.New(fmt.Sprintf("no certificates found in webdav CA %s\n", caFile))
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	etags := &etagTransport{next: transport}
+	client.SetTransport(etags)
+	return client, etags, nil
+}
+
+// retryable are connection errors and server errors, other status codes
+// (e.g. not found or precondition failed) are answers
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		if status, ok := pathErr.Err.(gowebdav.StatusError); ok {
+			return status.Status >= 500
+		}
+	}
+	return true
+}
+
+// retry calls f up to Retries additional times with a growing pause
+func (s *WebDAVState) retry(f func() error) error {
+	err := f()
+	for i := 0; i < s.Retries && retryable(err); i++ {
+		klog.Warningf("webdav request failed, retrying: %v\n", err)
+		time.Sleep(time.Duration(i+1) * time.Second)
+		err = f()
+	}
+	return err
+}
+
+func (s *WebDAVState) path() string {
+	return filepath.Join(s.Directory, s.File)
+}
+
+func (s *WebDAVState) etag() (string, error) {
+	var info os.FileInfo
+	err := s.retry(func() (err error) {
+		info, err = s.Client.Stat(s.path())
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if file, ok := info.(*gowebdav.File); ok {
+		return file.ETag(), nil
+	}
+	return "", nil
+}
+
+// Save writes conditionally with If-Match on the ETag of the loaded state,
+// or If-None-Match for a new state, so the server refuses outdated writes.
+// The new revision is the ETag of the PUT response, without one it stays
+// empty and the next Save fails with ErrConflict, so the caller reloads.
+func (s *WebDAVState) Save(state *State) error {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	jsonData, err := json.Marshal(data)
+	jsonData, err := encode(state)
 	if err != nil {
-		return errors.New(fmt.Sprintf("could not encode data to json: %v\n", err))
+		return err
 	}
-	if err = s.Client.Write(filepath.Join(s.Directory, s.File), jsonData, 0644); err != nil {
+
+	s.Client.SetInterceptor(func(method string, rq *http.Request) {
+		if method != "PUT" {
+			return
+		}
+		if state.Revision == "" {
+			rq.Header.Set("If-None-Match", "*")
+		} else {
+			rq.Header.Set("If-Match", state.Revision)
+		}
+	})
+	s.ETags.etag = ""
+	err = s.retry(func() error { return s.Client.Write(s.path(), jsonData, 0644) })
+	s.Client.SetInterceptor(nil)
+	if gowebdav.IsErrCode(err, http.StatusPreconditionFailed) {
+		return ErrConflict
+	}
+	if err != nil {
 		return errors.New(fmt.Sprintf("could not write state: %v\n", err))
 	}
+
+	state.Revision = s.ETags.etag
 	return nil
 }
 
-func (s *WebDAVState) Get() ([]byte, error) {
+func (s *WebDAVState) Load() (*State, error) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	bytes, err := s.Client.Read(filepath.Join(s.Directory, s.File))
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("could not read state: %v\n", err))
+
+	// the ETag is read before and after the content, retry if the state
+	// was written in between
+	for i := 0; i < 3; i++ {
+		before, err := s.etag()
+		if gowebdav.IsErrNotFound(err) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not read state: %v\n", err))
+		}
+		var bytes []byte
+		err = s.retry(func() (err error) {
+			bytes, err = s.Client.Read(s.path())
+			return err
+		})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not read state: %v\n", err))
+		}
+		if after, err := s.etag(); err != nil || after != before {
+			continue
+		}
+		state, err := Decode(bytes)
+		if err != nil {
+			return nil, err
+		}
+		state.Revision = before
+		return state, nil
 	}
-	return bytes, nil
+	return nil, ErrConflict
 }
 
-func (s *WebDAVState) init() error {
-	if err := s.Client.Mkdir(s.Directory, 0644); err != nil {
-		klog.Errorf("could not init state directory: %v\n", err)
-		// EREMOTEIO
-		os.Exit(121)
+func (s *WebDAVState) Delete() error {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if err := s.retry(func() error { return s.Client.RemoveAll(s.Directory) }); err != nil {
+		return errors.New(fmt.Sprintf("could not delete state: %v\n", err))
 	}
 	return nil
 }
 
-func NewWebDavState() *WebDAVState {
+// init creates the state directory of the node, an existing directory
+// from an earlier run is fine
+func (s *WebDAVState) init() error {
+	err := s.retry(func() error { return s.Client.Mkdir(s.Directory, 0755) })
+	if err == nil {
+		return nil
+	}
+	if info, statErr := s.Client.Stat(s.Directory); statErr == nil && info.IsDir() {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("could not init state directory %s: %v\n", s.Directory, err))
+}
+
+func newWebDavState(config WebDAVConfig) (*WebDAVState, error) {
+	client, etags, err := newWebDAVClient(config)
+	if err != nil {
+		return nil, err
+	}
 	state := &WebDAVState{
-		Client:    gowebdav.NewClient("http://podnat-state-store:80", "", ""),
+		Client:    client,
+		ETags:     etags,
 		Directory: common.NodeID,
 		File:      "state.json",
+		Retries:   config.Retries,
 	}
+	if err := state.init(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
 
-	_ = state.init()
-
-	return state
+func NewWebDavState() (*WebDAVState, error) {
+	return newWebDavState(WebDAVConfig{
+		URI:       common.StateURI,
+		SecretDir: common.StateSecretDir,
+		CAFile:    common.StateCAFile,
+		Timeout:   time.Duration(common.StateTimeout) * time.Second,
+		Retries:   common.StateRetries,
+	})
 }
@@ -0,0 +1,212 @@
+package state
+
+import (
+	"encoding/pem"
+	"github.com/gutmensch/podnat-controller/internal/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// conditional adds If-Match and If-None-Match support for PUT requests,
+// which the x/net webdav handler does not implement
+func conditional(h http.Handler) http.Handler {
+	var mutex sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			h.ServeHTTP(w, r)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		head := httptest.NewRecorder()
+		h.ServeHTTP(head, httptest.NewRequest(http.MethodHead, r.URL.Path, nil))
+		etag := ""
+		if head.Code == http.StatusOK {
+			etag = head.Header().Get("ETag")
+		}
+		if match := r.Header.Get("If-Match"); match != "" && match != etag {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && etag != "" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestWebDAVStateConformance(t *testing.T) {
+	runConformance(t, func(t *testing.T) (StateStore, StateStore, func([]byte)) {
+		server := httptest.NewServer(conditional(&webdav.Handler{
+			FileSystem: webdav.NewMemFS(),
+			LockSystem: webdav.NewMemLS(),
+		}))
+		t.Cleanup(server.Close)
+		newStore := func() *WebDAVState {
+			client, etags, err := newWebDAVClient(WebDAVConfig{URI: server.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &WebDAVState{Client: client, ETags: etags, Directory: "node1", File: "state.json"}
+		}
+		a := newStore()
+		return a, newStore(), func(data []byte) {
+			if err := a.Client.Write(a.path(), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func newWebDAVHandler() http.Handler {
+	return conditional(&webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	})
+}
+
+func writeSecret(t *testing.T, data map[string]string) string {
+	dir := t.TempDir()
+	for key, value := range data {
+		if err := os.WriteFile(filepath.Join(dir, key), []byte(value+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestWebDAVStateRevisionOfOwnWrite(t *testing.T) {
+	common.NodeID = "node1"
+	h := newWebDAVHandler()
+	var interfere atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !interfere.CompareAndSwap(true, false) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// another writer updates the state right after this write
+		own := httptest.NewRecorder()
+		h.ServeHTTP(own, r)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, r.URL.Path, strings.NewReader(`{"version":2}`)))
+		for key, values := range own.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(own.Code)
+	}))
+	defer server.Close()
+
+	store, err := newWebDavState(WebDAVConfig{URI: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := NewState()
+	interfere.Store(true)
+	if err := store.Save(st); err != nil {
+		t.Fatal(err)
+	}
+	// the revision is the one of the own write, so the change of the other
+	// writer is detected instead of overwritten
+	if err := store.Save(st); err != ErrConflict {
+		t.Fatalf(`Save() after concurrent write = %v, want ErrConflict`, err)
+	}
+}
+
+func TestWebDAVStateExistingDirectory(t *testing.T) {
+	common.NodeID = "node1"
+	server := httptest.NewServer(newWebDAVHandler())
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := newWebDavState(WebDAVConfig{URI: server.URL}); err != nil {
+			t.Fatalf(`newWebDavState() run %d failed: %v`, i, err)
+		}
+	}
+}
+
+func TestWebDAVStateAuth(t *testing.T) {
+	common.NodeID = "node1"
+	handler := newWebDAVHandler()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if r.Header.Get("Authorization") != "Bearer secret-token" && !(ok && user == "podnat" && password == "secret") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="state"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	secrets := map[string]map[string]string{
+		"basic":  {"username": "podnat", "password": "secret"},
+		"bearer": {"token": "secret-token"},
+	}
+	for name, secret := range secrets {
+		store, err := newWebDavState(WebDAVConfig{URI: server.URL, SecretDir: writeSecret(t, secret)})
+		if err != nil {
+			t.Fatalf(`%s: newWebDavState() failed: %v`, name, err)
+		}
+		if err := store.Save(NewState()); err != nil && err != ErrConflict {
+			t.Fatalf(`%s: Save() failed: %v`, name, err)
+		}
+	}
+
+	if _, err := newWebDavState(WebDAVConfig{URI: server.URL, SecretDir: writeSecret(t, map[string]string{"token": "wrong"})}); err == nil {
+		t.Fatalf(`newWebDavState() with wrong token succeeded`)
+	}
+	if _, _, err := newWebDAVClient(WebDAVConfig{URI: server.URL, SecretDir: writeSecret(t, map[string]string{"username": "a", "token": "b"})}); err == nil {
+		t.Fatalf(`newWebDAVClient() with basic auth and token succeeded`)
+	}
+}
+
+func TestWebDAVStateCustomCA(t *testing.T) {
+	common.NodeID = "node1"
+	server := httptest.NewTLSServer(newWebDAVHandler())
+	defer server.Close()
+
+	if _, err := newWebDavState(WebDAVConfig{URI: server.URL}); err == nil {
+		t.Fatalf(`newWebDavState() trusted unknown CA`)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if _, err := newWebDavState(WebDAVConfig{URI: server.URL, SecretDir: writeSecret(t, map[string]string{"ca.crt": string(ca)})}); err != nil {
+		t.Fatalf(`newWebDavState() with CA failed: %v`, err)
+	}
+}
+
+func TestWebDAVStateRetries(t *testing.T) {
+	common.NodeID = "node1"
+	handler := newWebDAVHandler()
+	var failures int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	store, err := newWebDavState(WebDAVConfig{URI: server.URL, Timeout: time.Second, Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(NewState()); err != nil {
+		t.Fatalf(`Save() after one unavailable response failed: %v`, err)
+	}
+
+	store.Retries = 0
+	atomic.StoreInt32(&failures, 1)
+	if err := store.Save(NewState()); err == nil || err == ErrConflict {
+		t.Fatalf(`Save() without retries = %v, want server error`, err)
+	}
+}
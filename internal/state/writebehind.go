@@ -0,0 +1,156 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gutmensch/podnat-controller/internal/api"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// WriteBehindState skips writes without semantic change and collects
+// changes of LastVerified only, which are written every interval. The
+// decorator tracks the revision itself, conflicting changes by others are
+// returned by Save, so the caller can merge them after a Load.
+type WriteBehindState struct {
+	store    StateStore
+	interval time.Duration
+	revision string
+	written  string
+	pending  *State
+	mutex    sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// fingerprint hashes the rules without timestamps of the last refresh
+func fingerprint(rules map[string][]*api.NATRule) string {
+	stripped := make(map[string][]api.NATRule, len(rules))
+	for key, ruleList := range rules {
+		for _, rule := range ruleList {
+			r := *rule
+			r.LastVerified = time.Time{}
+			stripped[key] = append(stripped[key], r)
+		}
+	}
+	data, _ := json.Marshal(stripped)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// snapshot copies s, the caller keeps modifying its rules
+func snapshot(s *State) *State {
+	c := *s
+	c.Rules = make(map[string][]*api.NATRule, len(s.Rules))
+	for key, ruleList := range s.Rules {
+		for _, rule := range ruleList {
+			r := *rule
+			c.Rules[key] = append(c.Rules[key], &r)
+		}
+	}
+	return &c
+}
+
+func (w *WriteBehindState) Load() (*State, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	s, err := w.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	w.revision = s.Revision
+	w.written = fingerprint(s.Rules)
+	return s, nil
+}
+
+func (w *WriteBehindState) Save(s *State) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if fingerprint(s.Rules) == w.written {
+		w.pending = snapshot(s)
+		return nil
+	}
+	w.pending = nil
+	if err := w.write(snapshot(s)); err != nil {
+		return err
+	}
+	s.Revision = w.revision
+	return nil
+}
+
+func (w *WriteBehindState) Delete() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = nil
+	w.revision = ""
+	w.written = ""
+	return w.store.Delete()
+}
+
+// write saves s with the tracked revision
+func (w *WriteBehindState) write(s *State) error {
+	s.Revision = w.revision
+	if err := w.store.Save(s); err != nil {
+		return err
+	}
+	w.revision = s.Revision
+	w.written = fingerprint(s.Rules)
+	return nil
+}
+
+// Flush writes collected timestamp changes. After a change by others the
+// refreshes are dropped, the next Save then reports the conflict.
+func (w *WriteBehindState) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.pending == nil {
+		return nil
+	}
+	err := w.write(w.pending)
+	if errors.Is(err, ErrConflict) {
+		klog.Warningf("state was changed by another writer, dropping collected refreshes\n")
+		w.pending = nil
+		w.written = ""
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w.pending = nil
+	return nil
+}
+
+func (w *WriteBehindState) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-time.After(w.interval):
+		}
+		if err := w.Flush(); err != nil {
+			klog.Warningf("could not flush state: %v\n", err)
+		}
+	}
+}
+
+// Shutdown stops the flush loop and writes collected changes a last time.
+func (w *WriteBehindState) Shutdown() error {
+	close(w.stop)
+	<-w.done
+	return w.Flush()
+}
+
+func NewWriteBehindState(store StateStore, interval time.Duration) *WriteBehindState {
+	w := &WriteBehindState{
+		store:    store,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
@@ -0,0 +1,121 @@
+package state
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingState counts writes to a file state
+type countingState struct {
+	*FileState
+	saves int
+}
+
+func (c *countingState) Save(s *State) error {
+	c.saves++
+	return c.FileState.Save(s)
+}
+
+func TestWriteBehindStateCoalescesTimestamps(t *testing.T) {
+	file, err := newFileState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &countingState{FileState: file}
+	w := NewWriteBehindState(store, time.Hour)
+
+	s := NewState()
+	s.Rules["1.2.3.4:25"] = testRule(25)
+	if err := w.Save(s); err != nil {
+		t.Fatal(err)
+	}
+	// refresh only, written on flush
+	for i := 0; i < 5; i++ {
+		s.Rules["1.2.3.4:25"][0].LastVerified = time.Now()
+		if err := w.Save(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if store.saves != 1 {
+		t.Fatalf(`saves after refreshes = %d, want 1`, store.saves)
+	}
+
+	// semantic changes are written immediately
+	s.Rules["1.2.3.4:143"] = testRule(143)
+	if err := w.Save(s); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 2 {
+		t.Fatalf(`saves after new rule = %d, want 2`, store.saves)
+	}
+
+	s.Rules["1.2.3.4:25"][0].LastVerified = time.Now()
+	if err := w.Save(s); err != nil {
+		t.Fatal(err)
+	}
+	lastVerified := s.Rules["1.2.3.4:25"][0].LastVerified
+	// later changes by the caller do not leak into the pending write
+	s.Rules["1.2.3.4:25"][0].LastVerified = time.Time{}
+	if err := w.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 3 {
+		t.Fatalf(`saves after shutdown = %d, want 3`, store.saves)
+	}
+	loaded, err := file.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Rules["1.2.3.4:25"][0].LastVerified.Equal(lastVerified) {
+		t.Fatalf(`flushed LastVerified = %v, want %v`, loaded.Rules["1.2.3.4:25"][0].LastVerified, lastVerified)
+	}
+	if err := w.Flush(); err != nil || store.saves != 3 {
+		t.Fatalf(`flush without pending changes wrote state (%v)`, err)
+	}
+}
+
+func TestWriteBehindStateReportsConflicts(t *testing.T) {
+	file, err := newFileState(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriteBehindState(file, time.Hour)
+	defer w.Shutdown()
+
+	s := NewState()
+	s.Rules["1.2.3.4:25"] = testRule(25)
+	if err := w.Save(s); err != nil {
+		t.Fatal(err)
+	}
+	// another writer, e.g. the state subcommand
+	other, _ := file.Load()
+	delete(other.Rules, "1.2.3.4:25")
+	if err := file.Save(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// collected refreshes do not overwrite the change
+	s.Rules["1.2.3.4:25"][0].LastVerified = time.Now()
+	if err := w.Save(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ := file.Load(); len(loaded.Rules) != 0 {
+		t.Fatalf(`state after flush = %v, want the change of the other writer`, loaded.Rules)
+	}
+
+	// the next write reports the conflict until the caller loaded the state
+	if err := w.Save(s); !errors.Is(err, ErrConflict) {
+		t.Fatalf(`Save() after foreign write error = %v, want ErrConflict`, err)
+	}
+	if _, err := w.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s.Rules["1.2.3.4:143"] = testRule(143)
+	if err := w.Save(s); err != nil {
+		t.Fatalf(`Save() after Load() failed: %v`, err)
+	}
+}